@@ -0,0 +1,244 @@
+package rcache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns a handler exposing the state of the cache and actions
+// on it, meant to be mounted under /debug/rcache/:
+//
+//	GET  /             stats and a summary of the local tiers
+//	GET  /key?key=     the entry stored under key
+//	POST /invalidate   deletes key= or the keys starting with prefix=
+//	POST /flush-local  empties the in-process tier
+//
+// All but the first require the header "Authorization: Bearer <token>", and
+// are disabled if token is empty. Invalidating deletes entries from Redis and
+// the local tiers of this process only, never from the DataSource. Prefixes
+// skip the keys the cache keeps for itself, such as leases and the
+// write-behind stream.
+func (c *Cache) AdminHandler(token string) http.Handler {
+	return &adminHandler{c: c, token: token}
+}
+
+type adminHandler struct {
+	c     *Cache
+	token string
+}
+
+type adminSummary struct {
+	Hits          uint64       `json:"hits"`
+	Misses        uint64       `json:"misses"`
+	HitRatio      float64      `json:"hit_ratio"`
+	Local         *tierSummary `json:"local,omitempty"`
+	Disk          *tierSummary `json:"disk,omitempty"`
+	Refreshing    int          `json:"refreshing"`
+	Subscriptions int          `json:"subscriptions"`
+	WriteBehind   bool         `json:"write_behind"`
+	Invalidator   bool         `json:"invalidator"`
+}
+
+type tierSummary struct {
+	Type string `json:"type"`
+	// Entries is omitted for tiers that cannot count their entries.
+	Entries *int  `json:"entries,omitempty"`
+	TTL     int64 `json:"ttl_ms"`
+}
+
+type adminEntry struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Size     int         `json:"size"`
+	TTL      int64       `json:"ttl_ms"`
+	StoredAt *time.Time  `json:"stored_at,omitempty"`
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/key"):
+		h.action(w, r, http.MethodGet, h.lookup)
+	case strings.HasSuffix(path, "/invalidate"):
+		h.action(w, r, http.MethodPost, h.invalidate)
+	case strings.HasSuffix(path, "/flush-local"):
+		h.action(w, r, http.MethodPost, h.flushLocal)
+	default:
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminJSON(w, h.summary())
+	}
+}
+
+func (h *adminHandler) action(w http.ResponseWriter, r *http.Request, method string, fn func(http.ResponseWriter, *http.Request)) {
+	if r.Method != method {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.token == "" {
+		adminError(w, http.StatusForbidden, "actions are disabled")
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(h.token)) != 1 {
+		adminError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	fn(w, r)
+}
+
+func (h *adminHandler) summary() *adminSummary {
+	c := h.c
+	stats := c.Stats()
+	s := &adminSummary{Hits: stats.Hits, Misses: stats.Misses}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		s.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	if c.Local != nil {
+		s.Local = newTierSummary(c.Local, c.localTTL())
+	}
+	if c.Disk != nil {
+		s.Disk = newTierSummary(c.Disk, c.diskTTL())
+	}
+	c.mu.Lock()
+	s.Refreshing = len(c.refreshers)
+	s.Subscriptions = len(c.subscriptions)
+	s.WriteBehind = c.writer != nil
+	s.Invalidator = c.invalidator != nil
+	c.mu.Unlock()
+	return s
+}
+
+func newTierSummary(tier LocalCache, ttl time.Duration) *tierSummary {
+	s := &tierSummary{
+		Type: strings.TrimPrefix(fmt.Sprintf("%T", tier), "*"),
+		TTL:  int64(ttl / time.Millisecond),
+	}
+	if l, ok := tier.(interface{ Len() int }); ok {
+		n := l.Len()
+		s.Entries = &n
+	}
+	return s
+}
+
+func (h *adminHandler) lookup(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	if key == "" {
+		adminError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+	item, err := h.c.GetItem(key, nil)
+	if err == ErrCacheMiss {
+		adminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	e := &adminEntry{Key: key, Size: item.Size, TTL: int64(item.TTL / time.Millisecond)}
+	if json.Valid(item.Value) {
+		e.Value = json.RawMessage(item.Value)
+	} else {
+		e.Value = string(item.Value)
+	}
+	if !item.StoredAt.IsZero() {
+		e.StoredAt = &item.StoredAt
+	}
+	adminJSON(w, e)
+}
+
+func (h *adminHandler) invalidate(w http.ResponseWriter, r *http.Request) {
+	key, prefix := r.FormValue("key"), r.FormValue("prefix")
+	if (key == "") == (prefix == "") {
+		adminError(w, http.StatusBadRequest, "either key or prefix is required")
+		return
+	}
+
+	conn, err := h.c.getConn()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer conn.Close()
+	deleted := 0
+	del := func(keys []string) error {
+		for _, key := range keys {
+			if prefix != "" && h.c.internal(key) {
+				continue
+			}
+			if err := h.c.mirrorDelete(key); err != nil {
+				return err
+			}
+			if err := h.c.delValue(conn, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	}
+	if key != "" {
+		err = del([]string{key})
+	} else {
+		pattern := escapeGlob(prefix) + "*"
+		err = scan(conn, pattern, del)
+		if err == nil && h.c.MigrateFrom != nil {
+			// Keys not migrated yet would be copied back on the next miss.
+			// Those found above were already deleted from it.
+			old := h.c.MigrateFrom.Get()
+			err = scan(old, pattern, del)
+			old.Close()
+		}
+	}
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, fmt.Sprintf("%d keys deleted: %v", deleted, err))
+		return
+	}
+	adminJSON(w, map[string]int{"deleted": deleted})
+}
+
+func (h *adminHandler) flushLocal(w http.ResponseWriter, r *http.Request) {
+	if h.c.Local == nil {
+		adminError(w, http.StatusNotFound, "there is no in-process tier")
+		return
+	}
+	purger, ok := h.c.Local.(interface{ Purge() })
+	if !ok {
+		adminError(w, http.StatusNotImplemented, "the in-process tier cannot be flushed")
+		return
+	}
+	purger.Purge()
+	adminJSON(w, map[string]bool{"flushed": true})
+}
+
+// escapeGlob escapes the special characters of Redis patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
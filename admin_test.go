@@ -0,0 +1,137 @@
+package rcache_test
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/lcd1232/redis-cache/rcachetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newAdminServer(t *testing.T, c *rcache.Cache, token string) *httptest.Server {
+	srv := httptest.NewServer(c.AdminHandler(token))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// adminDo sends a request to the admin handler and decodes the JSON reply
+// into v if it is not nil.
+func adminDo(t *testing.T, srv *httptest.Server, method, path, token string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAuth(t *testing.T) {
+	c := rcache.NewRedisCache(rcachetest.NewFake(), json.Marshal, json.Unmarshal)
+	srv := newAdminServer(t, c, "secret")
+
+	if status := adminDo(t, srv, "GET", "/", "", nil); status != http.StatusOK {
+		t.Errorf("summary returned %d, want 200", status)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if status := adminDo(t, srv, "GET", "/key?key=k", token, nil); status != http.StatusUnauthorized {
+			t.Errorf("lookup with token %q returned %d, want 401", token, status)
+		}
+	}
+	if status := adminDo(t, srv, "GET", "/invalidate?key=k", "secret", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /invalidate returned %d, want 405", status)
+	}
+
+	disabled := newAdminServer(t, c, "")
+	if status := adminDo(t, disabled, "POST", "/invalidate?key=k", "", nil); status != http.StatusForbidden {
+		t.Errorf("invalidate without a token configured returned %d, want 403", status)
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	c := rcache.NewRedisCache(rcachetest.NewFake(), json.Marshal, json.Unmarshal)
+	c.StoreMetadata = true
+	if err := c.Set(&rcache.Item{Key: "k", Object: map[string]int{"a": 1}, Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	srv := newAdminServer(t, c, "secret")
+
+	var entry struct {
+		Value    map[string]int `json:"value"`
+		TTL      int64          `json:"ttl_ms"`
+		StoredAt *time.Time     `json:"stored_at"`
+	}
+	if status := adminDo(t, srv, "GET", "/key?key=k", "secret", &entry); status != http.StatusOK {
+		t.Fatalf("lookup returned %d, want 200", status)
+	}
+	if entry.Value["a"] != 1 || entry.TTL <= 0 || entry.StoredAt == nil {
+		t.Errorf("lookup returned %+v", entry)
+	}
+	if status := adminDo(t, srv, "GET", "/key?key=missing", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("lookup of a missing key returned %d, want 404", status)
+	}
+
+	var reply map[string]int
+	if status := adminDo(t, srv, "POST", "/invalidate?key=k", "secret", &reply); status != http.StatusOK || reply["deleted"] != 1 {
+		t.Errorf("invalidate returned %d, %v", status, reply)
+	}
+	if err := c.Get("k", nil); err != rcache.ErrCacheMiss {
+		t.Errorf("Get after invalidate = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestAdminPrefix(t *testing.T) {
+	pool := rcachetest.NewFake()
+	c := newWriteBehindCache(pool, newMemSource(), "test")
+	for _, key := range []string{"rcache:a", "rcache:b", "{rcache}:c", "other"} {
+		if err := c.Set(&rcache.Item{Key: key, Object: "v", Expiration: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leaves the lease of a miss behind.
+	if _, err := c.GetLease("{rcache}:missing", nil); err != rcache.ErrCacheMiss {
+		t.Fatal(err)
+	}
+	srv := newAdminServer(t, c, "secret")
+
+	var reply map[string]int
+	for _, prefix := range []string{"rcache:", "%7Brcache%7D:"} {
+		if status := adminDo(t, srv, "POST", "/invalidate?prefix="+prefix, "secret", &reply); status != http.StatusOK {
+			t.Fatalf("invalidate of prefix %s returned %d", prefix, status)
+		}
+	}
+	if reply["deleted"] != 1 {
+		t.Errorf("invalidate of {rcache}: deleted %d keys, want 1", reply["deleted"])
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	for key, want := range map[string]bool{
+		"rcache:a":                      false,
+		"rcache:b":                      false,
+		"{rcache}:c":                    false,
+		"other":                         true,
+		"rcache:write-behind":           true,
+		"rcache:write-behind:latest":    true,
+		"{rcache}:missing:rcache-lease": true,
+	} {
+		if exists, err := redis.Bool(conn.Do("EXISTS", key)); err != nil || exists != want {
+			t.Errorf("EXISTS %s = %v, %v, want %v", key, exists, err, want)
+		}
+	}
+}
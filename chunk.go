@@ -0,0 +1,243 @@
+package rcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"regexp"
+	"time"
+)
+
+// Values larger than Cache.ChunkSize are stored as numbered chunk keys and a
+// manifest under the key itself. The manifest starts with manifestMagic
+// followed by the JSON encoded manifest. Stored values cannot start with it,
+// see reservedPrefix.
+var manifestMagic = []byte{0xff, 'r', 'c', 'm'}
+
+// Chunks outlive their manifest by chunkGrace, so that readers of a manifest
+// never find its chunks expired.
+const chunkGrace = time.Minute
+
+// chunkKeyPattern matches the names chunkKey returns.
+var chunkKeyPattern = regexp.MustCompile(`:rcache-chunk:[0-9a-f]{32}:[0-9]+$`)
+
+var ErrChecksumMismatch = errors.New("cache: chunked value checksum mismatch")
+
+type manifest struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+	CRC32  uint32 `json:"crc32"`
+}
+
+// chunkKey returns the name of chunk i, which shares the hash slot of key so
+// that the chunks can be deleted at once on Redis Cluster.
+func (m *manifest) chunkKey(key string, i int) string {
+	return reservedKey(key, fmt.Sprintf("chunk:%s:%d", m.ID, i))
+}
+
+func (m *manifest) chunkKeys(key string) []interface{} {
+	keys := make([]interface{}, m.Chunks)
+	for i := range keys {
+		keys[i] = m.chunkKey(key, i)
+	}
+	return keys
+}
+
+func parseManifest(v []byte) (*manifest, bool) {
+	if !bytes.HasPrefix(v, manifestMagic) {
+		return nil, false
+	}
+	var m manifest
+	if err := json.Unmarshal(v[len(manifestMagic):], &m); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+func (m *manifest) encode() []byte {
+	b, _ := json.Marshal(m)
+	return append(append([]byte{}, manifestMagic...), b...)
+}
+
+// setScript sets the value and returns the replaced value if it was a
+// manifest, so that its chunks can be deleted.
+var setScript = redis.NewScript(1, `
+-- rcache:set
+local old = false
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	old = redis.call("GET", KEYS[1])
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+if old and string.sub(old, 1, 4) == ARGV[3] then
+	return old
+end
+return false
+`)
+
+// delScript deletes the key together with its lease and returns its value if
+// it was a manifest.
+var delScript = redis.NewScript(2, `
+-- rcache:del
+local old = false
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	old = redis.call("GET", KEYS[1])
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+if old and string.sub(old, 1, 4) == ARGV[1] then
+	return old
+end
+return false
+`)
+
+// writeChunks stores v in chunks if it exceeds ChunkSize and returns the
+// manifest to store under key. Smaller values are returned unchanged.
+func (c *Cache) writeChunks(conn redis.Conn, key string, v []byte, expire time.Duration) ([]byte, error) {
+	if c.ChunkSize <= 0 || len(v) <= c.ChunkSize {
+		return v, nil
+	}
+	id, err := newToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "newToken failed")
+	}
+	m := &manifest{
+		ID:     id,
+		Chunks: (len(v) + c.ChunkSize - 1) / c.ChunkSize,
+		Size:   len(v),
+		CRC32:  crc32.ChecksumIEEE(v),
+	}
+	ttl := milliseconds(expire) + int64(chunkGrace/time.Millisecond)
+	for i := 0; i < m.Chunks; i++ {
+		end := (i + 1) * c.ChunkSize
+		if end > len(v) {
+			end = len(v)
+		}
+		if err := conn.Send("SET", m.chunkKey(key, i), v[i*c.ChunkSize:end], "PX", ttl); err != nil {
+			return nil, errors.Wrap(err, "Redis SET failed")
+		}
+	}
+	if err := checkReplies(conn.Do("")); err != nil {
+		return nil, errors.Wrap(err, "Redis SET failed")
+	}
+	return m.encode(), nil
+}
+
+// sendSet queues setting key to v, which was returned by writeChunks. The
+// reply must be passed to setReply.
+func (c *Cache) sendSet(conn redis.Conn, key string, v []byte, expire time.Duration) error {
+	if c.ChunkSize <= 0 {
+		return conn.Send("SETEX", key, int(expiration(expire).Seconds()), v)
+	}
+	return setScript.Send(conn, key, v, milliseconds(expire), manifestMagic)
+}
+
+func (c *Cache) setReply(conn redis.Conn, key string, reply interface{}) error {
+	if err, ok := reply.(redis.Error); ok {
+		return err
+	}
+	if c.ChunkSize <= 0 || reply == nil {
+		return nil
+	}
+	return c.deleteReplaced(conn, key, reply)
+}
+
+func (c *Cache) sendDel(conn redis.Conn, key string) error {
+	return delScript.Send(conn, key, leaseKey(key), manifestMagic)
+}
+
+func (c *Cache) delReply(conn redis.Conn, key string, reply interface{}) error {
+	c.deleteLocal(key)
+	if err, ok := reply.(redis.Error); ok {
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+	return c.deleteReplaced(conn, key, reply)
+}
+
+func (c *Cache) deleteReplaced(conn redis.Conn, key string, reply interface{}) error {
+	old, err := redis.Bytes(reply, nil)
+	if err != nil {
+		return err
+	}
+	if m, ok := parseManifest(old); ok {
+		return c.deleteChunks(conn, key, m)
+	}
+	return nil
+}
+
+func (c *Cache) deleteChunks(conn redis.Conn, key string, m *manifest) error {
+	if m.Chunks == 0 {
+		return nil
+	}
+	if _, err := conn.Do("DEL", m.chunkKeys(key)...); err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	return nil
+}
+
+func (c *Cache) expireChunks(conn redis.Conn, key string, m *manifest, ttl time.Duration) error {
+	ms := int64((ttl + chunkGrace) / time.Millisecond)
+	for _, chunk := range m.chunkKeys(key) {
+		if err := conn.Send("PEXPIRE", chunk, ms); err != nil {
+			return errors.Wrap(err, "Redis PEXPIRE failed")
+		}
+	}
+	if err := checkReplies(conn.Do("")); err != nil {
+		return errors.Wrap(err, "Redis PEXPIRE failed")
+	}
+	return nil
+}
+
+// resolve reassembles v if it is a manifest. A value with missing chunks is
+// reported as redis.ErrNil.
+func (c *Cache) resolve(conn redis.Conn, key string, v []byte) ([]byte, *manifest, error) {
+	m, ok := parseManifest(v)
+	if !ok {
+		return v, nil, nil
+	}
+	if m.Chunks == 0 {
+		return []byte{}, m, nil
+	}
+	for _, chunk := range m.chunkKeys(key) {
+		if err := conn.Send("GET", chunk); err != nil {
+			return nil, m, err
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, m, err
+	}
+	b := make([]byte, 0, m.Size)
+	for _, reply := range replies {
+		chunk, err := redis.Bytes(reply, nil)
+		if err != nil {
+			return nil, m, err
+		}
+		b = append(b, chunk...)
+	}
+	if len(b) != m.Size || crc32.ChecksumIEEE(b) != m.CRC32 {
+		return nil, m, ErrChecksumMismatch
+	}
+	return b, m, nil
+}
+
+func checkReplies(reply interface{}, err error) error {
+	if reply == nil && err == nil {
+		return nil
+	}
+	replies, err := redis.Values(reply, err)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
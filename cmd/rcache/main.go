@@ -0,0 +1,355 @@
+// Command rcache inspects and manages the entries of a cache.
+//
+// It connects with the URL given by -url or with the configuration read
+// from the environment by rcache.ConfigFromEnv, e.g. REDIS_URL.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+const usage = `Usage: rcache [flags] <command> [arguments]
+
+Commands:
+  get <key>            print the value of key
+  set <key> <value>    store value, which is stored as is
+  del <key>...         delete keys
+  ttl <key>            print the remaining time to live of key
+  scan [pattern]       list the keys matching pattern, * by default
+  stats                print server statistics
+  export <pattern> <file>
+                       write the keys matching pattern to file, - for stdout,
+                       in which case the -json summary goes to stderr
+  import <file>        restore the keys exported to file, - for stdin
+
+Flags:
+`
+
+var (
+	rawurl   = flag.String("url", "", "Redis URL, read from the environment if empty")
+	env      = flag.String("env", "REDIS", "prefix of the environment variables")
+	jsonOut  = flag.Bool("json", false, "print JSON")
+	ttl      = flag.Duration("ttl", 0, "expiration of set, 2 minutes if under a second")
+	metadata = flag.Bool("metadata", false, "store metadata with set, see Cache.StoreMetadata")
+
+	rebaseTTL    = flag.Bool("rebase-ttl", false, "import keys with their TTL at export time, see ImportOptions")
+	skipExisting = flag.Bool("skip-existing", false, "do not replace existing keys on import")
+)
+
+type command struct {
+	args int // minimum number of arguments
+	run  func(c *rcache.Cache, args []string) error
+}
+
+var commands = map[string]command{
+	"get":    {1, get},
+	"set":    {2, set},
+	"del":    {1, del},
+	"ttl":    {1, ttlCommand},
+	"scan":   {0, scan},
+	"stats":  {0, stats},
+	"export": {2, export},
+	"import": {1, importCommand},
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || len(args)-1 < cmd.args {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newCache()
+	if err == nil {
+		err = cmd.run(c, args[1:])
+		c.Close()
+	}
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rcache:", err)
+		os.Exit(1)
+	}
+}
+
+func newCache() (*rcache.Cache, error) {
+	var cfg *rcache.Config
+	var err error
+	if *rawurl != "" {
+		cfg, err = rcache.ParseURL(*rawurl)
+	} else {
+		cfg, err = rcache.ConfigFromEnv(*env)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := cfg.NewCache()
+	c.StoreMetadata = *metadata
+	return c, nil
+}
+
+func printJSON(v interface{}) error {
+	return writeJSON(os.Stdout, v)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// jsonValue returns v as JSON if it is valid JSON, and as a string
+// otherwise.
+func jsonValue(v []byte) interface{} {
+	if json.Valid(v) {
+		return json.RawMessage(v)
+	}
+	return string(v)
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+type entry struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Size     int         `json:"size"`
+	TTL      int64       `json:"ttl_ms"`
+	StoredAt *time.Time  `json:"stored_at,omitempty"`
+}
+
+func get(c *rcache.Cache, args []string) error {
+	item, err := c.GetItem(args[0], nil)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		e := entry{Key: item.Key, Value: jsonValue(item.Value), Size: item.Size, TTL: milliseconds(item.TTL)}
+		if !item.StoredAt.IsZero() {
+			e.StoredAt = &item.StoredAt
+		}
+		return printJSON(e)
+	}
+	return printValue(os.Stdout, item.Value)
+}
+
+// printValue indents JSON values and quotes values that are not text.
+func printValue(w io.Writer, v []byte) error {
+	var buf bytes.Buffer
+	switch {
+	case json.Valid(v) && json.Indent(&buf, v, "", "  ") == nil:
+		buf.WriteByte('\n')
+	case utf8.Valid(v):
+		buf.Write(v)
+		buf.WriteByte('\n')
+	default:
+		buf.WriteString(strconv.Quote(string(v)))
+		buf.WriteByte('\n')
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func set(c *rcache.Cache, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return c.Set(&rcache.Item{Key: args[0], Value: []byte(args[1]), Expiration: *ttl})
+}
+
+func del(c *rcache.Cache, args []string) error {
+	for _, key := range args {
+		if err := c.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ttlCommand(c *rcache.Cache, args []string) error {
+	item, err := c.GetItem(args[0], nil)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(map[string]interface{}{"key": item.Key, "ttl_ms": milliseconds(item.TTL)})
+	}
+	if item.TTL == 0 {
+		fmt.Println("no expiration")
+		return nil
+	}
+	fmt.Println(item.TTL)
+	return nil
+}
+
+func scan(c *rcache.Cache, args []string) error {
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	keys := []string{}
+	err := c.Scan(pattern, func(key string) error {
+		if *jsonOut {
+			keys = append(keys, key)
+			return nil
+		}
+		_, err := fmt.Println(key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		sort.Strings(keys)
+		return printJSON(keys)
+	}
+	return nil
+}
+
+// statsFields are the fields of INFO printed by stats, besides the keyspace.
+var statsFields = []string{
+	"redis_version", "uptime_in_seconds", "connected_clients",
+	"used_memory", "used_memory_human", "maxmemory", "maxmemory_policy",
+	"keyspace_hits", "keyspace_misses", "expired_keys", "evicted_keys",
+}
+
+func stats(c *rcache.Cache, args []string) error {
+	conn := c.Redis.Get()
+	defer conn.Close()
+	info, err := redis.String(conn.Do("INFO"))
+	if err != nil {
+		return err
+	}
+
+	fields := make(map[string]string)
+	var names []string
+	for _, line := range strings.Split(info, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	for _, name := range statsFields {
+		if _, ok := fields[name]; ok {
+			names = append(names, name)
+		}
+	}
+	var dbs []string
+	for name := range fields {
+		if strings.HasPrefix(name, "db") {
+			if _, err := strconv.Atoi(name[2:]); err == nil {
+				dbs = append(dbs, name)
+			}
+		}
+	}
+	sort.Strings(dbs)
+	names = append(names, dbs...)
+
+	hits, _ := strconv.ParseFloat(fields["keyspace_hits"], 64)
+	misses, _ := strconv.ParseFloat(fields["keyspace_misses"], 64)
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = hits / (hits + misses)
+	}
+
+	if *jsonOut {
+		out := make(map[string]interface{}, len(names)+1)
+		for _, name := range names {
+			out[name] = fields[name]
+		}
+		out["hit_ratio"] = ratio
+		return printJSON(out)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, fields[name])
+	}
+	fmt.Fprintf(w, "hit_ratio\t%.4f\n", ratio)
+	return w.Flush()
+}
+
+func export(c *rcache.Cache, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	w := os.Stdout
+	if args[1] != "-" {
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := c.Export(ctx, args[0], w)
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	if *jsonOut {
+		// The summary must not follow the export on stdout.
+		if w == os.Stdout {
+			return writeJSON(os.Stderr, map[string]int{"exported": n})
+		}
+		return printJSON(map[string]int{"exported": n})
+	}
+	fmt.Fprintf(os.Stderr, "%d keys exported\n", n)
+	return nil
+}
+
+func importCommand(c *rcache.Cache, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	r := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	result, err := c.Import(ctx, r, rcache.ImportOptions{RebaseTTL: *rebaseTTL, SkipExisting: *skipExisting})
+	if result != nil {
+		if *jsonOut {
+			printJSON(map[string]int{"restored": result.Restored, "skipped": result.Skipped, "expired": result.Expired})
+		} else {
+			fmt.Fprintf(os.Stderr, "%d keys restored, %d skipped, %d expired\n", result.Restored, result.Skipped, result.Expired)
+		}
+	}
+	return err
+}
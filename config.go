@@ -0,0 +1,298 @@
+package rcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes how to connect to Redis. It can be parsed from a URL with
+// ParseURL or read from the environment with ConfigFromEnv.
+type Config struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// Credentials, if set, is called for each new connection and overrides
+	// Username and Password, so that rotated passwords take effect without a
+	// restart.
+	Credentials func() (username, password string, err error)
+
+	// TLS enables TLS, which is verified against TLSCAFile or the system
+	// roots. TLSCertFile and TLSKeyFile set a client certificate. The files
+	// are read for each new connection, so they can be rotated in place.
+	// TLSConfig, if set, is used instead of the other TLS options.
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+	TLSConfig             *tls.Config
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// PoolSize limits the number of connections, 0 means no limit. When the
+	// limit is reached, getting a connection waits for one to be released.
+	PoolSize        int
+	MaxIdle         int
+	IdleTimeout     time.Duration
+	MaxConnLifetime time.Duration
+
+	// Marshal and Unmarshal default to encoding/json.
+	Marshal   MarshalFunc
+	Unmarshal UnmarshalFunc
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:         "localhost:6379",
+		DialTimeout:  5 * time.Second,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+		MaxIdle:      10,
+		IdleTimeout:  5 * time.Minute,
+	}
+}
+
+// ParseURL parses URLs of the form
+// redis[s]://[user[:password]@]host[:port][/db][?option=value...], where
+// options are the snake case names of the Config fields, e.g. pool_size or
+// dial_timeout.
+func ParseURL(rawurl string) (*Config, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, errors.Errorf("invalid redis URL scheme: %s", u.Scheme)
+	}
+
+	cfg := defaultConfig()
+	cfg.TLS = u.Scheme == "rediss"
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "6379"
+	}
+	cfg.Addr = net.JoinHostPort(host, port)
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			cfg.Username, cfg.Password = u.User.Username(), password
+		} else {
+			// A single userinfo component is the password of the default user.
+			cfg.Password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if cfg.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid database: %s", db)
+		}
+	}
+	for name, values := range u.Query() {
+		if err := cfg.set(name, values[len(values)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// ConfigFromEnv reads the configuration from the environment. If
+// <prefix>_URL is set, it is parsed with ParseURL. Other variables are named
+// after the Config fields, e.g. <prefix>_ADDR or <prefix>_POOL_SIZE, and
+// override the URL.
+func ConfigFromEnv(prefix string) (*Config, error) {
+	cfg := defaultConfig()
+	if rawurl := os.Getenv(prefix + "_URL"); rawurl != "" {
+		var err error
+		if cfg, err = ParseURL(rawurl); err != nil {
+			return nil, errors.Wrapf(err, "%s_URL", prefix)
+		}
+	}
+	for _, name := range configOptions {
+		key := prefix + "_" + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(key); ok {
+			if err := cfg.set(name, value); err != nil {
+				return nil, errors.Wrap(err, key)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+var configOptions = []string{
+	"addr", "username", "password", "db",
+	"tls", "tls_ca_file", "tls_cert_file", "tls_key_file", "tls_server_name", "tls_insecure_skip_verify",
+	"dial_timeout", "read_timeout", "write_timeout",
+	"pool_size", "max_idle", "idle_timeout", "max_conn_lifetime",
+}
+
+func (cfg *Config) set(name, value string) error {
+	var err error
+	switch name {
+	case "addr":
+		cfg.Addr = value
+	case "username":
+		cfg.Username = value
+	case "password":
+		cfg.Password = value
+	case "db":
+		cfg.DB, err = strconv.Atoi(value)
+	case "tls":
+		cfg.TLS, err = strconv.ParseBool(value)
+	case "tls_ca_file":
+		cfg.TLSCAFile = value
+	case "tls_cert_file":
+		cfg.TLSCertFile = value
+	case "tls_key_file":
+		cfg.TLSKeyFile = value
+	case "tls_server_name":
+		cfg.TLSServerName = value
+	case "tls_insecure_skip_verify":
+		cfg.TLSInsecureSkipVerify, err = strconv.ParseBool(value)
+	case "dial_timeout":
+		cfg.DialTimeout, err = time.ParseDuration(value)
+	case "read_timeout":
+		cfg.ReadTimeout, err = time.ParseDuration(value)
+	case "write_timeout":
+		cfg.WriteTimeout, err = time.ParseDuration(value)
+	case "pool_size":
+		cfg.PoolSize, err = strconv.Atoi(value)
+	case "max_idle":
+		cfg.MaxIdle, err = strconv.Atoi(value)
+	case "idle_timeout":
+		cfg.IdleTimeout, err = time.ParseDuration(value)
+	case "max_conn_lifetime":
+		cfg.MaxConnLifetime, err = time.ParseDuration(value)
+	default:
+		return errors.Errorf("unknown option %q", name)
+	}
+	return errors.Wrapf(err, "invalid %s", name)
+}
+
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSConfig != nil {
+		return cfg.TLSConfig, nil
+	}
+	c := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.TLSCAFile)
+		}
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func (cfg *Config) dial() (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(cfg.DialTimeout),
+		redis.DialReadTimeout(cfg.ReadTimeout),
+		redis.DialWriteTimeout(cfg.WriteTimeout),
+		redis.DialUseTLS(cfg.TLS),
+	}
+	if cfg.TLS {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "TLS config failed")
+		}
+		options = append(options, redis.DialTLSConfig(tlsConfig))
+	}
+	username, password := cfg.Username, cfg.Password
+	if cfg.Credentials != nil {
+		var err error
+		if username, password, err = cfg.Credentials(); err != nil {
+			return nil, errors.Wrap(err, "Credentials failed")
+		}
+	}
+
+	conn, err := redis.Dial("tcp", cfg.Addr, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis dial failed")
+	}
+	if password != "" {
+		args := []interface{}{password}
+		if username != "" {
+			args = []interface{}{username, password}
+		}
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Redis AUTH failed")
+		}
+	}
+	if cfg.DB != 0 {
+		if _, err := conn.Do("SELECT", cfg.DB); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Redis SELECT failed")
+		}
+	}
+	return conn, nil
+}
+
+// Pool returns a connection pool for the configuration.
+func (cfg *Config) Pool() *redis.Pool {
+	return &redis.Pool{
+		Dial:            cfg.dial,
+		MaxIdle:         cfg.MaxIdle,
+		MaxActive:       cfg.PoolSize,
+		IdleTimeout:     cfg.IdleTimeout,
+		MaxConnLifetime: cfg.MaxConnLifetime,
+		Wait:            cfg.PoolSize > 0,
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+// NewCache returns a cache using a new pool for the configuration.
+func (cfg *Config) NewCache() *Cache {
+	marshal, unmarshal := cfg.Marshal, cfg.Unmarshal
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	return NewRedisCache(cfg.Pool(), marshal, unmarshal)
+}
+
+// NewFromURL returns a cache for the Redis server at rawurl, see ParseURL.
+// Values are marshalled with encoding/json.
+func NewFromURL(rawurl string) (*Cache, error) {
+	cfg, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.NewCache(), nil
+}
@@ -0,0 +1,234 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// DataSource is the backing store of a cache. Values are passed marshalled
+// with the cache's MarshalFunc so that queued writes survive restarts. Load
+// must return ErrCacheMiss for keys that do not exist.
+type DataSource interface {
+	Load(key string) ([]byte, error)
+	Store(key string, value []byte) error
+	Delete(key string) error
+}
+
+// BatchDataSource is implemented by data sources that can apply several
+// write-behind operations at once.
+type BatchDataSource interface {
+	DataSource
+	StoreMulti(values map[string][]byte) error
+	DeleteMulti(keys []string) error
+}
+
+type WriteMode int
+
+const (
+	// WriteThrough writes to the DataSource and then to the cache.
+	WriteThrough WriteMode = iota
+	// WriteBehind writes to the cache and queues the DataSource write in a
+	// Redis stream, which is applied by StartWriteBehind.
+	WriteBehind
+)
+
+func (c *Cache) write(item *Item) error {
+	b, err := c.marshal(item)
+	if err != nil {
+		return err
+	}
+
+	if c.WriteMode == WriteThrough {
+		if err := c.DataSource.Store(item.Key, b); err != nil {
+			return errors.Wrap(err, "DataSource.Store failed")
+		}
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if c.WriteMode == WriteThrough {
+		if err := c.setValue(conn, item.Key, b, item.Expiration); err != nil {
+			return err
+		}
+		return c.mirrorSet(item.Key, b, item.Expiration)
+	}
+	v := c.encode(b)
+	stored, err := c.writeChunks(conn, item.Key, v, item.Expiration)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send("MULTI"); err != nil {
+		return errors.Wrap(err, "Redis MULTI failed")
+	}
+	if err := c.sendSet(conn, item.Key, stored, item.Expiration); err != nil {
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	if err := c.enqueue(conn, opStore, item.Key, b); err != nil {
+		return err
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return errors.Wrap(err, "Redis EXEC failed")
+	}
+	if err := c.setReply(conn, item.Key, replies[0]); err != nil {
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	c.setLocal(item.Key, v, item.Expiration)
+	return c.mirrorSet(item.Key, b, item.Expiration)
+}
+
+// writeMulti is write for several items, whose marshalled values are given.
+func (c *Cache) writeMulti(items []*Item, values [][]byte) error {
+	if c.WriteMode == WriteThrough {
+		if batch, ok := c.DataSource.(BatchDataSource); ok {
+			stores := make(map[string][]byte, len(items))
+			for i, item := range items {
+				stores[item.Key] = values[i]
+			}
+			if err := batch.StoreMulti(stores); err != nil {
+				return errors.Wrap(err, "DataSource.StoreMulti failed")
+			}
+		} else {
+			for i, item := range items {
+				if err := c.DataSource.Store(item.Key, values[i]); err != nil {
+					return errors.Wrapf(err, "DataSource.Store of %q failed", item.Key)
+				}
+			}
+		}
+		return c.setMulti(items, values)
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	encoded := make([][]byte, len(items))
+	stored := make([][]byte, len(items))
+	for i, item := range items {
+		encoded[i] = c.encode(values[i])
+		if stored[i], err = c.writeChunks(conn, item.Key, encoded[i], item.Expiration); err != nil {
+			return err
+		}
+	}
+	if err := conn.Send("MULTI"); err != nil {
+		return errors.Wrap(err, "Redis MULTI failed")
+	}
+	for i, item := range items {
+		if err := c.sendSet(conn, item.Key, stored[i], item.Expiration); err != nil {
+			return errors.Wrap(err, "Redis SET failed")
+		}
+		if err := c.enqueue(conn, opStore, item.Key, values[i]); err != nil {
+			return err
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return errors.Wrap(err, "Redis EXEC failed")
+	}
+	// Replies alternate between SET and XADD.
+	for i, item := range items {
+		if err := c.setReply(conn, item.Key, replies[2*i]); err != nil {
+			return errors.Wrap(err, "Redis SET failed")
+		}
+		c.setLocal(item.Key, encoded[i], item.Expiration)
+	}
+	for i, item := range items {
+		if err := c.mirrorSet(item.Key, values[i], item.Expiration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) remove(key string) error {
+	if c.WriteMode == WriteThrough {
+		if err := c.DataSource.Delete(key); err != nil {
+			return errors.Wrap(err, "DataSource.Delete failed")
+		}
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if c.WriteMode == WriteThrough {
+		return c.delValue(conn, key)
+	}
+	if err := conn.Send("MULTI"); err != nil {
+		return errors.Wrap(err, "Redis MULTI failed")
+	}
+	if err := c.sendDel(conn, key); err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	if err := c.enqueue(conn, opDelete, key, nil); err != nil {
+		return err
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return errors.Wrap(err, "Redis EXEC failed")
+	}
+	if err := c.delReply(conn, key, replies[0]); err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	return nil
+}
+
+// load reads a missing key from the DataSource. The loaded value is only
+// cached if the key was not deleted while loading, see GetLease.
+func (c *Cache) load(conn redis.Conn, key string, object interface{}) error {
+	lease, _, err := c.lock(leaseKey(key), c.leaseTimeout())
+	if err != nil {
+		return err
+	}
+	b, err := c.loadValue(conn, key)
+	if err != nil {
+		// Other readers would wait for the lease to expire.
+		if lease != "" {
+			if err := c.unlock(leaseKey(key), lease); err != nil {
+				c.handleError(err)
+			}
+		}
+		return err
+	}
+	if lease != "" {
+		err := c.setLeased(conn, &Item{Key: key, Value: b, Expiration: c.LoadExpiration}, lease)
+		if err != nil && err != ErrLeaseInvalid {
+			return err
+		}
+	}
+	return c.unmarshal(b, object)
+}
+
+// loadValue returns the value of key in the DataSource. In WriteBehind mode,
+// a write of key that is still queued takes precedence, since the DataSource
+// does not reflect it yet.
+func (c *Cache) loadValue(conn redis.Conn, key string) ([]byte, error) {
+	if c.WriteMode == WriteBehind {
+		op, err := c.queuedWrite(conn, key)
+		if err != nil {
+			return nil, err
+		}
+		if op != nil {
+			if op.op == opDelete {
+				return nil, ErrCacheMiss
+			}
+			return op.value, nil
+		}
+	}
+	b, err := c.DataSource.Load(key)
+	if err == ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "DataSource.Load failed")
+	}
+	return b, nil
+}
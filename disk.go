@@ -0,0 +1,307 @@
+package rcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry files start with diskMagic, followed by the expiration time in Unix
+// milliseconds (0 for none), the CRC32 of the rest of the file, the key
+// length and the key, and end with the value.
+var diskMagic = []byte{'r', 'c', 'd', 1}
+
+const (
+	diskHeaderSize      = 20
+	diskFileSuffix      = ".rc"
+	diskTempPrefix      = ".tmp-"
+	diskCompactInterval = time.Minute
+)
+
+// DiskCache is a LocalCache storing one file per key, meant as a tier between
+// the in-process tier and a distant Redis. Entries are written to a temporary
+// file and renamed into place, so a crash never leaves a partial entry.
+// Expired entries are removed by compaction, which also evicts the least
+// recently used entries once the files exceed the maximum size.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	compact chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	errors  func(error)
+}
+
+// NewDiskCache opens or creates a disk cache in dir. Compaction runs in the
+// background until Close is called, its errors are passed to errorHandler if
+// it is not nil.
+func NewDiskCache(dir string, maxSize int64, errorHandler func(error)) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		compact: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		errors:  errorHandler,
+	}
+	if err := d.Compact(); err != nil {
+		return nil, err
+	}
+	go d.run()
+	return d, nil
+}
+
+func (d *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name+diskFileSuffix)
+}
+
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	value, _, ok := d.GetTTL(key)
+	return value, ok
+}
+
+// GetTTL is like Get but also returns the remaining TTL of the entry, 0 if
+// it does not expire.
+func (d *DiskCache) GetTTL(key string) ([]byte, time.Duration, bool) {
+	path := d.path(key)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, false
+	}
+	expires, storedKey, value, ok := parseDiskEntry(b)
+	if !ok || storedKey != key {
+		return nil, 0, false
+	}
+	now := time.Now()
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	if expires != 0 && nowMs > expires {
+		d.Delete(key)
+		return nil, 0, false
+	}
+	var ttl time.Duration
+	if expires != 0 {
+		// Rounded up, as 0 would mean no expiration.
+		ttl = time.Duration(expires-nowMs+1) * time.Millisecond
+	}
+	// The modification time orders entries for eviction.
+	os.Chtimes(path, now, now)
+	return value, ttl, true
+}
+
+func (d *DiskCache) Set(key string, value []byte, ttl time.Duration) {
+	if err := d.set(key, value, ttl); err != nil && d.errors != nil {
+		d.errors(err)
+	}
+}
+
+func (d *DiskCache) set(key string, value []byte, ttl time.Duration) error {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	}
+	b := make([]byte, diskHeaderSize+len(key)+len(value))
+	copy(b, diskMagic)
+	binary.BigEndian.PutUint64(b[4:], uint64(expires))
+	binary.BigEndian.PutUint32(b[16:], uint32(len(key)))
+	copy(b[diskHeaderSize:], key)
+	copy(b[diskHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(b[12:], crc32.ChecksumIEEE(b[16:]))
+
+	path := d.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := ioutil.TempFile(dir, diskTempPrefix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	var old int64
+	if fi, err := os.Stat(path); err == nil {
+		old = fi.Size()
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+
+	d.mu.Lock()
+	d.size += int64(len(b)) - old
+	over := d.size > d.maxSize
+	d.mu.Unlock()
+	if over {
+		select {
+		case d.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (d *DiskCache) Delete(key string) {
+	path := d.path(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if os.Remove(path) == nil {
+		d.mu.Lock()
+		d.size -= fi.Size()
+		d.mu.Unlock()
+	}
+}
+
+// Close stops background compaction.
+func (d *DiskCache) Close() error {
+	close(d.stop)
+	<-d.done
+	return nil
+}
+
+func (d *DiskCache) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(diskCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.compact:
+		}
+		if err := d.Compact(); err != nil && d.errors != nil {
+			d.errors(err)
+		}
+	}
+}
+
+type diskFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Compact removes expired and corrupt entries and leftover temporary files,
+// and evicts the least recently used entries until the cache is below 90% of
+// its maximum size.
+func (d *DiskCache) Compact() error {
+	now := time.Now()
+	var files []diskFile
+	var size int64
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), diskTempPrefix) {
+			// Files of writes interrupted by a crash.
+			if now.Sub(fi.ModTime()) > diskCompactInterval {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(fi.Name(), diskFileSuffix) {
+			return nil
+		}
+		if expired, err := diskFileExpired(path, now); err != nil || expired {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, diskFile{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "disk cache compaction failed")
+	}
+
+	if size > d.maxSize {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+		target := d.maxSize / 10 * 9
+		for _, f := range files {
+			if size <= target {
+				break
+			}
+			if os.Remove(f.path) == nil {
+				size -= f.size
+			}
+		}
+	}
+
+	d.mu.Lock()
+	d.size = size
+	d.mu.Unlock()
+	return nil
+}
+
+func diskFileExpired(path string, now time.Time) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, err
+	}
+	if !bytes.HasPrefix(header, diskMagic) {
+		return false, errors.New("invalid disk cache entry")
+	}
+	expires := int64(binary.BigEndian.Uint64(header[4:]))
+	return expires != 0 && now.UnixNano()/int64(time.Millisecond) > expires, nil
+}
+
+func parseDiskEntry(b []byte) (int64, string, []byte, bool) {
+	if len(b) < diskHeaderSize || !bytes.HasPrefix(b, diskMagic) {
+		return 0, "", nil, false
+	}
+	if crc32.ChecksumIEEE(b[16:]) != binary.BigEndian.Uint32(b[12:]) {
+		return 0, "", nil, false
+	}
+	n := int(binary.BigEndian.Uint32(b[16:]))
+	if len(b) < diskHeaderSize+n {
+		return 0, "", nil, false
+	}
+	expires := int64(binary.BigEndian.Uint64(b[4:]))
+	return expires, string(b[diskHeaderSize : diskHeaderSize+n]), b[diskHeaderSize+n:], true
+}
@@ -0,0 +1,223 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	EventExpired = "expired"
+	EventEvicted = "evicted"
+)
+
+// keyspaceFlags are the notify-keyspace-events flags needed for
+// subscriptions: keyspace channels (K) with expired (x) and evicted (e)
+// events.
+const keyspaceFlags = "Kxe"
+
+const healthCheckInterval = 30 * time.Second
+
+// reservedKeyPattern matches the names reservedKey returns for the lease,
+// the refresh lock and the chunks of a key.
+var reservedKeyPattern = regexp.MustCompile(`:rcache-(lease|refresh-lock|chunk:[0-9a-f]{32}:[0-9]+)$`)
+
+type KeyEvent struct {
+	Event string
+	Key   string
+}
+
+// Subscription delivers key events until it is closed. Events are sent to C
+// unless the subscription was created with a callback.
+type Subscription struct {
+	C <-chan KeyEvent
+
+	c       *Cache
+	channel string
+	events  map[string]bool
+	fn      func(KeyEvent)
+	ch      chan KeyEvent
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// EnableKeyspaceEvents adds the flags needed by subscriptions to the
+// notify-keyspace-events setting of the server. Managed Redis services often
+// disallow CONFIG, in which case the setting must be changed by other means.
+func (c *Cache) EnableKeyspaceEvents() error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return errors.Wrap(err, "Redis CONFIG GET failed")
+	}
+	flags := ""
+	if len(reply) == 2 {
+		flags = reply[1]
+	}
+	for _, flag := range keyspaceFlags {
+		if !strings.ContainsRune(flags, flag) && !(flag != 'K' && strings.ContainsRune(flags, 'A')) {
+			flags += string(flag)
+		}
+	}
+	if _, err := conn.Do("CONFIG", "SET", "notify-keyspace-events", flags); err != nil {
+		return errors.Wrap(err, "Redis CONFIG SET failed")
+	}
+	return nil
+}
+
+// SubscribeKeyEvents subscribes to the given events of keys matching
+// pattern, which uses the glob-style syntax of Redis. Events of the keys
+// the cache stores next to a key, such as leases and chunks, are left out.
+// The subscription reconnects on errors until it or the cache is closed.
+func (c *Cache) SubscribeKeyEvents(pattern string, events ...string) *Subscription {
+	return c.subscribe(pattern, nil, events...)
+}
+
+// OnExpire calls fn with each key matching pattern that expires.
+func (c *Cache) OnExpire(pattern string, fn func(key string)) *Subscription {
+	return c.subscribe(pattern, func(e KeyEvent) { fn(e.Key) }, EventExpired)
+}
+
+// OnEvict calls fn with each key matching pattern that is evicted.
+func (c *Cache) OnEvict(pattern string, fn func(key string)) *Subscription {
+	return c.subscribe(pattern, func(e KeyEvent) { fn(e.Key) }, EventEvicted)
+}
+
+func (c *Cache) subscribe(pattern string, fn func(KeyEvent), events ...string) *Subscription {
+	s := &Subscription{
+		c:       c,
+		channel: "__keyspace@*__:" + pattern,
+		events:  make(map[string]bool, len(events)),
+		fn:      fn,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, event := range events {
+		s.events[event] = true
+	}
+	if fn == nil {
+		s.ch = make(chan KeyEvent, 128)
+		s.C = s.ch
+	}
+
+	c.mu.Lock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[*Subscription]struct{})
+	}
+	c.subscriptions[s] = struct{}{}
+	c.mu.Unlock()
+
+	go s.run()
+	return s
+}
+
+func (s *Subscription) Close() error {
+	s.c.mu.Lock()
+	_, ok := s.c.subscriptions[s]
+	delete(s.c.subscriptions, s)
+	s.c.mu.Unlock()
+	if ok {
+		s.close()
+	}
+	return nil
+}
+
+func (s *Subscription) close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+	if s.ch != nil {
+		defer close(s.ch)
+	}
+	var backoff time.Duration
+	for {
+		err := s.receive()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.c.handleError(errors.Wrap(err, "key event subscription failed"))
+
+		backoff = nextBackoff(backoff, time.Minute)
+		if !sleep(backoff, s.stop) {
+			return
+		}
+	}
+}
+
+func (s *Subscription) receive() error {
+	psc := redis.PubSubConn{Conn: s.c.Redis.Get()}
+	defer psc.Close()
+	if err := psc.PSubscribe(s.channel); err != nil {
+		return err
+	}
+
+	// Receive is unblocked by unsubscribing on stop, and pings detect dead
+	// connections.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-s.stop:
+				psc.PUnsubscribe()
+				return
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * healthCheckInterval).(type) {
+		case redis.Message:
+			s.deliver(v)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return errors.New("unsubscribed")
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (s *Subscription) deliver(m redis.Message) {
+	event := string(m.Data)
+	if !s.events[event] {
+		return
+	}
+	i := strings.Index(m.Channel, "__:")
+	if i < 0 {
+		return
+	}
+	e := KeyEvent{Event: event, Key: m.Channel[i+3:]}
+	if reservedKeyPattern.MatchString(e.Key) {
+		return
+	}
+	if s.fn != nil {
+		s.fn(e)
+		return
+	}
+	select {
+	case s.ch <- e:
+	case <-s.stop:
+	}
+}
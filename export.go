@@ -0,0 +1,269 @@
+package rcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Exports start with exportMagic, whose last byte is the format version,
+// followed by the export time in Unix milliseconds. Each key is a record
+// made of exportEntry, the key, its remaining TTL in milliseconds (-1 for
+// none) and its DUMP payload, with lengths and the TTL as varints. The
+// export ends with exportEnd and the number of keys.
+var exportMagic = []byte{'r', 'c', 'x', 1}
+
+const (
+	exportEnd   byte = 0
+	exportEntry byte = 1
+	// maxExportField bounds the lengths read from an export, so that a
+	// corrupt file fails instead of allocating huge buffers.
+	maxExportField = 512 << 20
+	importBatch    = 100
+)
+
+var ErrInvalidExport = errors.New("cache: invalid export")
+
+// Export writes the keys matching pattern with their remaining TTLs to w,
+// and returns the number of keys written. Values are exported with DUMP,
+// so any type is supported, but they can only be imported into a Redis
+// version at least as recent.
+func (c *Cache) Export(ctx context.Context, pattern string, w io.Writer) (int, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(exportMagic)+8)
+	copy(header, exportMagic)
+	binary.BigEndian.PutUint64(header[len(exportMagic):], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	if _, err := bw.Write(header); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	n := 0
+	buf := make([]byte, binary.MaxVarintLen64)
+	err = scan(conn, pattern, func(keys []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := conn.Send("DUMP", key); err != nil {
+				return errors.Wrap(err, "Redis DUMP failed")
+			}
+			if err := conn.Send("PTTL", key); err != nil {
+				return errors.Wrap(err, "Redis PTTL failed")
+			}
+		}
+		replies, err := redis.Values(conn.Do(""))
+		if err != nil {
+			return errors.Wrap(err, "Redis DUMP failed")
+		}
+		for i, key := range keys {
+			payload, err := redis.Bytes(replies[2*i], nil)
+			if err == redis.ErrNil {
+				// The key expired or was deleted since it was scanned.
+				continue
+			}
+			if err != nil {
+				return errors.Wrap(err, "Redis DUMP failed")
+			}
+			pttl, err := redis.Int64(replies[2*i+1], nil)
+			if err != nil {
+				return errors.Wrap(err, "Redis PTTL failed")
+			}
+			if pttl == -2 {
+				continue
+			}
+
+			bw.WriteByte(exportEntry)
+			bw.Write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+			bw.WriteString(key)
+			bw.Write(buf[:binary.PutVarint(buf, pttl)])
+			bw.Write(buf[:binary.PutUvarint(buf, uint64(len(payload)))])
+			if _, err := bw.Write(payload); err != nil {
+				return errors.WithStack(err)
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	bw.WriteByte(exportEnd)
+	bw.Write(buf[:binary.PutUvarint(buf, uint64(n))])
+	if err := bw.Flush(); err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+type ImportOptions struct {
+	// RebaseTTL restores keys with the TTL they had when exported, counted
+	// from the import. By default, the time elapsed since the export is
+	// deducted and keys that expired in the meantime are skipped.
+	RebaseTTL bool
+	// SkipExisting keeps keys that already exist instead of replacing them.
+	SkipExisting bool
+}
+
+type ImportResult struct {
+	Restored int
+	// Skipped counts existing keys kept because of SkipExisting.
+	Skipped int
+	// Expired counts keys that expired since the export.
+	Expired int
+}
+
+type exportRecord struct {
+	key     string
+	pttl    int64
+	payload []byte
+}
+
+// Import restores the keys of an export written by Export. The local tiers
+// of this cache are cleared for the restored keys, those of other processes
+// are not.
+func (c *Cache) Import(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(exportMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.HasPrefix(header, exportMagic) {
+		return nil, ErrInvalidExport
+	}
+	exportedAt := int64(binary.BigEndian.Uint64(header[len(exportMagic):]))
+	elapsed := time.Now().UnixNano()/int64(time.Millisecond) - exportedAt
+	if opts.RebaseTTL || elapsed < 0 {
+		elapsed = 0
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	result := &ImportResult{}
+	batch := make([]exportRecord, 0, importBatch)
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		rec, total, err := readExportRecord(br)
+		if err != nil {
+			return result, err
+		}
+		if rec == nil {
+			// A missing end record or count means a truncated export.
+			if total != uint64(count) {
+				return result, ErrInvalidExport
+			}
+			break
+		}
+		count++
+
+		if rec.pttl >= 0 {
+			rec.pttl -= elapsed
+			if rec.pttl <= 0 {
+				result.Expired++
+				continue
+			}
+		} else {
+			rec.pttl = 0
+		}
+		batch = append(batch, *rec)
+		if len(batch) == importBatch {
+			if err := c.restore(conn, batch, opts, result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := c.restore(conn, batch, opts, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// readExportRecord returns the next record, or nil and the number of keys
+// of the export at its end.
+func readExportRecord(br *bufio.Reader) (*exportRecord, uint64, error) {
+	kind, err := br.ReadByte()
+	if err != nil {
+		return nil, 0, ErrInvalidExport
+	}
+	if kind == exportEnd {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, 0, ErrInvalidExport
+		}
+		return nil, n, nil
+	}
+	if kind != exportEntry {
+		return nil, 0, ErrInvalidExport
+	}
+	key, err := readExportField(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec := &exportRecord{key: string(key)}
+	if rec.pttl, err = binary.ReadVarint(br); err != nil {
+		return nil, 0, ErrInvalidExport
+	}
+	if rec.payload, err = readExportField(br); err != nil {
+		return nil, 0, err
+	}
+	return rec, 0, nil
+}
+
+func readExportField(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > maxExportField {
+		return nil, ErrInvalidExport
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, ErrInvalidExport
+	}
+	return b, nil
+}
+
+func (c *Cache) restore(conn redis.Conn, batch []exportRecord, opts ImportOptions, result *ImportResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	for _, rec := range batch {
+		args := []interface{}{rec.key, rec.pttl, rec.payload}
+		if !opts.SkipExisting {
+			args = append(args, "REPLACE")
+		}
+		if err := conn.Send("RESTORE", args...); err != nil {
+			return errors.Wrap(err, "Redis RESTORE failed")
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return errors.Wrap(err, "Redis RESTORE failed")
+	}
+	for i, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			if opts.SkipExisting && strings.HasPrefix(string(err), "BUSYKEY") {
+				result.Skipped++
+				continue
+			}
+			return errors.Wrapf(err, "Redis RESTORE of %q failed", batch[i].key)
+		}
+		c.deleteLocal(batch[i].key)
+		result.Restored++
+	}
+	return nil
+}
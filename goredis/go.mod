@@ -0,0 +1,18 @@
+module github.com/lcd1232/redis-cache/goredis
+
+go 1.24
+
+replace github.com/lcd1232/redis-cache => ../
+
+require (
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/lcd1232/redis-cache v0.0.0
+	github.com/redis/go-redis/v9 v9.22.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,274 @@
+// Package goredis runs rcache on a go-redis client instead of a redigo pool.
+//
+// Commands are sent with the generic Do of go-redis, and commands queued with
+// Send are sent as one go-redis pipeline, so pipelining and scripts work as
+// with redigo. The client must use RESP2 (Protocol: 2), which the replies are
+// converted from, while go-redis defaults to RESP3. Key event subscriptions
+// are not supported. The client's ReadTimeout must exceed
+// WriteBehindOptions.PollInterval, as blocking reads are not extended.
+//
+// With a ClusterClient, WriteBehind cannot be used since it queues writes in
+// a MULTI spanning the written key and the stream, and SCAN based features
+// such as Cache.Scan, Migrator and prefix invalidation only see the keys of
+// one node. The other scripts and pipelines only combine keys of one slot.
+//
+// The cache is built on the connection interface of redigo, so this package
+// still depends on redigo, although redigo never connects to Redis here.
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	redigo "github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"time"
+)
+
+// ErrProtocol is returned for clients that do not use RESP2.
+var ErrProtocol = errors.New("goredis: the client must use RESP2 (Protocol: 2)")
+
+var (
+	errClosed      = errors.New("goredis: connection closed")
+	errNoReply     = errors.New("goredis: no pending reply")
+	errUnsupported = errors.New("goredis: pub/sub is not supported")
+)
+
+// Pool implements rcache.Pool with a go-redis client, which does its own
+// connection pooling. Connections of clients that do not use RESP2 fail
+// with ErrProtocol.
+type Pool struct {
+	Client redis.UniversalClient
+}
+
+func (p *Pool) Get() redigo.Conn {
+	return &conn{client: p.Client, err: checkProtocol(p.Client)}
+}
+
+// NewCache returns a cache using client, which must use RESP2.
+func NewCache(client redis.UniversalClient, marshalFunc rcache.MarshalFunc, unmarshalFunc rcache.UnmarshalFunc) (*rcache.Cache, error) {
+	if err := checkProtocol(client); err != nil {
+		return nil, err
+	}
+	return rcache.NewRedisCache(&Pool{Client: client}, marshalFunc, unmarshalFunc), nil
+}
+
+// checkProtocol rejects the go-redis clients using RESP3, which is their
+// default. Other implementations of UniversalClient are trusted.
+func checkProtocol(client redis.UniversalClient) error {
+	var protocol int
+	switch c := client.(type) {
+	case *redis.Client:
+		protocol = c.Options().Protocol
+	case *redis.ClusterClient:
+		protocol = c.Options().Protocol
+	case *redis.Ring:
+		protocol = c.Options().Protocol
+	default:
+		return nil
+	}
+	if protocol != 2 {
+		return ErrProtocol
+	}
+	return nil
+}
+
+// conn implements redigo.Conn. Commands queued with Send are sent on Flush,
+// Receive or Do.
+type conn struct {
+	client  redis.UniversalClient
+	pending [][]interface{}
+	replies []interface{}
+	closed  bool
+	err     error
+}
+
+func (c *conn) Close() error {
+	c.closed = true
+	c.pending, c.replies = nil, nil
+	return nil
+}
+
+func (c *conn) Err() error {
+	if c.closed {
+		return errClosed
+	}
+	return c.err
+}
+
+func (c *conn) Send(cmd string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if isPubSub(cmd) {
+		return errUnsupported
+	}
+	c.pending = append(c.pending, command(cmd, args))
+	return nil
+}
+
+func (c *conn) Flush() error {
+	return c.flush(0)
+}
+
+func (c *conn) flush(timeout time.Duration) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	replies, err := c.exec(timeout, c.pending)
+	c.pending = nil
+	if err != nil {
+		return err
+	}
+	c.replies = append(c.replies, replies...)
+	return nil
+}
+
+func (c *conn) Receive() (interface{}, error) {
+	return c.ReceiveWithTimeout(0)
+}
+
+func (c *conn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if err := c.flush(timeout); err != nil {
+		return nil, err
+	}
+	if len(c.replies) == 0 {
+		return nil, errNoReply
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(redigo.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoWithTimeout(0, cmd, args...)
+}
+
+// DoWithTimeout follows redigo: it sends the pending commands along with cmd
+// and returns the last reply and the first error reply. If cmd is empty, the
+// replies of the pending commands are returned instead.
+func (c *conn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if isPubSub(cmd) {
+		return nil, errUnsupported
+	}
+	if cmd != "" {
+		c.pending = append(c.pending, command(cmd, args))
+	}
+	if err := c.flush(timeout); err != nil {
+		return nil, err
+	}
+	replies := c.replies
+	c.replies = nil
+	if cmd == "" {
+		if len(replies) == 0 {
+			return nil, nil
+		}
+		return replies, nil
+	}
+	var err error
+	for _, reply := range replies {
+		if e, ok := reply.(redigo.Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+// exec sends cmds and returns their replies in redigo form. Error replies are
+// returned as redigo.Error values, other errors fail the whole call.
+func (c *conn) exec(timeout time.Duration, cmds [][]interface{}) ([]interface{}, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	results := make([]*redis.Cmd, len(cmds))
+	if len(cmds) == 1 {
+		results[0] = c.client.Do(ctx, cmds[0]...)
+	} else {
+		pipe := c.client.Pipeline()
+		for i, args := range cmds {
+			results[i] = pipe.Do(ctx, args...)
+		}
+		// Errors are checked per command below.
+		pipe.Exec(ctx)
+	}
+
+	replies := make([]interface{}, len(results))
+	for i, result := range results {
+		v, err := result.Result()
+		switch {
+		case err == redis.Nil:
+			replies[i] = nil
+		case err != nil:
+			var rerr redis.Error
+			if !errors.As(err, &rerr) {
+				return nil, err
+			}
+			replies[i] = redigo.Error(rerr.Error())
+		default:
+			replies[i] = convert(v)
+		}
+	}
+	return replies, nil
+}
+
+func command(cmd string, args []interface{}) []interface{} {
+	v := make([]interface{}, 0, len(args)+1)
+	v = append(v, cmd)
+	for _, arg := range args {
+		if a, ok := arg.(redigo.Argument); ok {
+			arg = a.RedisArg()
+		}
+		v = append(v, arg)
+	}
+	return v
+}
+
+func isPubSub(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE", "MONITOR":
+		return true
+	}
+	return false
+}
+
+// convert turns a go-redis reply into the types redigo returns: bulk and
+// status strings become []byte and nested errors become redigo.Error.
+func convert(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = convert(v[i])
+		}
+		return v
+	case error:
+		if v == redis.Nil {
+			return nil
+		}
+		return redigo.Error(v.Error())
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case float64:
+		return []byte(fmt.Sprint(v))
+	}
+	return v
+}
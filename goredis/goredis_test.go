@@ -0,0 +1,153 @@
+package goredis
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	redigo "github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/lcd1232/redis-cache/rcachetest"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// TestConformance runs against the Redis server at REDIS_ADDR, whose
+// database 15 is flushed before each test.
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	rcachetest.RunConformance(t, func(t *testing.T) rcache.Pool {
+		client := redis.NewClient(&redis.Options{Addr: addr, DB: 15, Protocol: 2})
+		t.Cleanup(func() { client.Close() })
+		if err := client.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatalf("FLUSHDB failed: %v", err)
+		}
+		return &Pool{Client: client}
+	})
+}
+
+// TestConformanceFake runs against a server answering with an rcachetest
+// Fake, so that the conversion of replies is checked without Redis.
+func TestConformanceFake(t *testing.T) {
+	rcachetest.RunConformance(t, func(t *testing.T) rcache.Pool {
+		client := redis.NewClient(&redis.Options{Addr: fakeServer(t), Protocol: 2, DisableIndentity: true})
+		t.Cleanup(func() { client.Close() })
+		return &Pool{Client: client}
+	})
+}
+
+// fakeServer serves the commands of RESP2 clients with a new Fake and
+// returns its address.
+func fakeServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fake := rcachetest.NewFake()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(nc, fake.Get())
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveFake(nc net.Conn, conn redigo.Conn) {
+	defer nc.Close()
+	defer conn.Close()
+	r, w := bufio.NewReader(nc), bufio.NewWriter(nc)
+	for {
+		argv, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		args := make([]interface{}, len(argv)-1)
+		for i, arg := range argv[1:] {
+			args[i] = arg
+		}
+		reply, err := conn.Do(string(argv[0]), args...)
+		if rerr, ok := err.(redigo.Error); ok {
+			reply = rerr
+		}
+		writeReply(w, reply)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command: %v", err)
+	}
+	argv := make([][]byte, n)
+	for i := range argv {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		argv[i] = make([]byte, size+2)
+		if _, err := io.ReadFull(r, argv[i]); err != nil {
+			return nil, err
+		}
+		argv[i] = argv[i][:size]
+	}
+	return argv, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case redigo.Error:
+		w.WriteString("-" + string(reply) + "\r\n")
+	case string:
+		w.WriteString("+" + reply + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(reply, 10) + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(reply)) + "\r\n")
+		w.Write(reply)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, v := range reply {
+			writeReply(w, v)
+		}
+	default:
+		w.WriteString(fmt.Sprintf("-ERR unexpected reply %T\r\n", reply))
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	resp3 := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer resp3.Close()
+	if _, err := NewCache(resp3, json.Marshal, json.Unmarshal); err != ErrProtocol {
+		t.Errorf("NewCache with a RESP3 client returned %v, want ErrProtocol", err)
+	}
+	conn := (&Pool{Client: resp3}).Get()
+	if _, err := conn.Do("PING"); err != ErrProtocol {
+		t.Errorf("Do with a RESP3 client returned %v, want ErrProtocol", err)
+	}
+
+	resp2 := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"localhost:6379"}, Protocol: 2})
+	defer resp2.Close()
+	if _, err := NewCache(resp2, json.Marshal, json.Unmarshal); err != nil {
+		t.Errorf("NewCache with a RESP2 client failed: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	ErrRequestInProgress  = errors.New("cache: request with this idempotency key is in progress")
+	ErrRequestMismatch    = errors.New("cache: idempotency key reused with a different request")
+	ErrReservationExpired = errors.New("cache: idempotency reservation expired")
+)
+
+// Reservations are stored as a hash with the fields state ("pending" or
+// "done"), hash (the request hash) and response (the marshalled response).
+var reserveScript = redis.NewScript(1, `
+-- rcache:reserve-idempotent
+local v = redis.call("HMGET", KEYS[1], "state", "hash", "response")
+if not v[1] then
+	redis.call("HMSET", KEYS[1], "state", "pending", "hash", ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return {"reserved"}
+end
+if v[2] ~= ARGV[1] then
+	return {"mismatch"}
+end
+if v[1] == "done" then
+	return {"done", v[3]}
+end
+return {"pending"}
+`)
+
+var completeScript = redis.NewScript(1, `
+-- rcache:complete-idempotent
+local v = redis.call("HMGET", KEYS[1], "state", "hash")
+if v[1] ~= "pending" or v[2] ~= ARGV[1] then
+	return 0
+end
+redis.call("HMSET", KEYS[1], "state", "done", "response", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+var releaseScript = redis.NewScript(1, `
+-- rcache:release-idempotent
+local v = redis.call("HMGET", KEYS[1], "state", "hash")
+if v[1] == "pending" and v[2] == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ReserveIdempotent atomically marks key as in progress for the request
+// identified by requestHash. It returns true if the caller should handle the
+// request and then call CompleteIdempotent or ReleaseIdempotent. If the request
+// was already handled, the stored response is unmarshalled into response and
+// false is returned. The reservation expires after timeout so that keys of
+// crashed handlers become available again.
+func (c *Cache) ReserveIdempotent(key, requestHash string, timeout time.Duration, response interface{}) (bool, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return false, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(reserveScript.Do(conn, key, requestHash, milliseconds(timeout)))
+	if err != nil {
+		return false, errors.Wrap(err, "Redis reserve script failed")
+	}
+	state, err := redis.String(reply[0], nil)
+	if err != nil {
+		return false, errors.Wrap(err, "unexpected reserve script reply")
+	}
+	switch state {
+	case "reserved":
+		return true, nil
+	case "mismatch":
+		return false, ErrRequestMismatch
+	case "pending":
+		return false, ErrRequestInProgress
+	}
+	b, err := redis.Bytes(reply[1], nil)
+	if err != nil {
+		return false, errors.Wrap(err, "unexpected reserve script reply")
+	}
+	return false, c.unmarshal(b, response)
+}
+
+// CompleteIdempotent stores the final response for a reservation made with
+// ReserveIdempotent. Duplicate requests receive it until expiration passes.
+func (c *Cache) CompleteIdempotent(key, requestHash string, response interface{}, expiration time.Duration) error {
+	b, err := c.Marshal(response)
+	if err != nil {
+		return errors.Wrap(err, "marshal failed")
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	ok, err := redis.Bool(completeScript.Do(conn, key, requestHash, b, milliseconds(expiration)))
+	if err != nil {
+		return errors.Wrap(err, "Redis complete script failed")
+	}
+	if !ok {
+		return ErrReservationExpired
+	}
+	return nil
+}
+
+// ReleaseIdempotent drops a pending reservation so that the request can be
+// retried, e.g. after the handler failed with a retryable error.
+func (c *Cache) ReleaseIdempotent(key, requestHash string) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if _, err := releaseScript.Do(conn, key, requestHash); err != nil {
+		return errors.Wrap(err, "Redis release script failed")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var ErrInvalidatorStarted = errors.New("cache: invalidator is already started")
+
+const (
+	defaultInvalidationSet = "rcache:invalidations"
+	invalidationBatch      = 100
+	// invalidationLease is how long a claimed delete is hidden from other
+	// instances. It is retried after that unless it was completed.
+	invalidationLease = 30 * time.Second
+)
+
+// claimScript leases the due pending deletes until ARGV[3] and returns them,
+// so that each of them is processed by one instance at a time.
+var claimScript = redis.NewScript(1, `
+-- rcache:claim-invalidations
+local keys = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, key in ipairs(keys) do
+	redis.call("ZADD", KEYS[1], "XX", ARGV[3], key)
+end
+return keys
+`)
+
+// completeInvalidationScript removes a claimed delete unless it was
+// scheduled again since.
+var completeInvalidationScript = redis.NewScript(1, `
+-- rcache:complete-invalidation
+if tonumber(redis.call("ZSCORE", KEYS[1], ARGV[1])) == tonumber(ARGV[2]) then
+	redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+type invalidator struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (c *Cache) invalidationSet() string {
+	if c.InvalidationSet != "" {
+		return c.InvalidationSet
+	}
+	return defaultInvalidationSet
+}
+
+// InvalidateAfterWrite deletes keys from the cache now and once more after
+// delay, which covers values cached from replicas that had not seen the write
+// yet. The second delete is recorded in Redis, so that any instance running
+// StartInvalidator completes it if this process dies.
+func (c *Cache) InvalidateAfterWrite(keys []string, delay time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	due := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+	args := []interface{}{c.invalidationSet()}
+	for _, key := range keys {
+		args = append(args, due, key)
+	}
+	if _, err := conn.Do("ZADD", args...); err != nil {
+		return errors.Wrap(err, "Redis ZADD failed")
+	}
+	for _, key := range keys {
+		if err := c.mirrorDelete(key); err != nil {
+			return err
+		}
+		if err := c.delValue(conn, key); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidations == nil {
+		c.invalidations = make(map[*time.Timer]struct{})
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		c.mu.Lock()
+		delete(c.invalidations, timer)
+		c.mu.Unlock()
+		if _, err := c.ProcessInvalidations(); err != nil {
+			c.handleError(errors.Wrap(err, "invalidation failed"))
+		}
+	})
+	c.invalidations[timer] = struct{}{}
+	return nil
+}
+
+// ProcessInvalidations deletes the keys whose second delete is due and
+// returns how many were deleted.
+func (c *Cache) ProcessInvalidations() (int, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	set := c.invalidationSet()
+	deleted := 0
+	for {
+		now := time.Now()
+		lease := now.Add(invalidationLease).UnixNano() / int64(time.Millisecond)
+		keys, err := redis.Strings(claimScript.Do(conn, set, now.UnixNano()/int64(time.Millisecond), invalidationBatch, lease))
+		if err != nil {
+			return deleted, errors.Wrap(err, "Redis claim script failed")
+		}
+		for _, key := range keys {
+			// Keys not completed are claimed again once their lease expires.
+			err := c.mirrorDelete(key)
+			if err == nil {
+				err = c.delValue(conn, key)
+			}
+			if err != nil {
+				return deleted, err
+			}
+			if _, err := completeInvalidationScript.Do(conn, set, key, lease); err != nil {
+				return deleted, errors.Wrap(err, "Redis complete script failed")
+			}
+			deleted++
+		}
+		if len(keys) < invalidationBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// StartInvalidator processes due invalidations every interval until Close
+// is called, including those left behind by other instances.
+func (c *Cache) StartInvalidator(interval time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidator != nil {
+		return ErrInvalidatorStarted
+	}
+	inv := &invalidator{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	c.invalidator = inv
+	go func() {
+		defer close(inv.done)
+		ticker := time.NewTicker(expiration(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-inv.stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := c.ProcessInvalidations(); err != nil {
+				c.handleError(errors.Wrap(err, "invalidation failed"))
+			}
+		}
+	}()
+	return nil
+}
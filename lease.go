@@ -0,0 +1,156 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrLeaseInvalid = errors.New("cache: lease is invalid")
+
+const defaultLeaseTimeout = 10 * time.Second
+
+// reservedKey returns the name of the key the cache keeps next to key for
+// name, such as its lease. Names ending in ":rcache-<name>" are reserved. The
+// name shares the hash slot of key, so that scripts can use both on Redis
+// Cluster, unless key contains "}" without forming a hash tag.
+func reservedKey(key, name string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			return key + ":rcache-" + name
+		}
+	}
+	return "{" + key + "}:rcache-" + name
+}
+
+func leaseKey(key string) string {
+	return reservedKey(key, "lease")
+}
+
+// getLeaseScript returns {1, value} on a hit. On a miss it hands out a lease
+// and returns {0, token}, or {0, false} if another lease is outstanding.
+var getLeaseScript = redis.NewScript(2, `
+-- rcache:get-lease
+local v = redis.call("GET", KEYS[1])
+if v then
+	return {1, v}
+end
+if redis.call("SET", KEYS[2], ARGV[1], "NX", "PX", ARGV[2]) then
+	return {0, ARGV[1]}
+end
+return {0, false}
+`)
+
+// setLeaseScript sets the value only if the lease is still valid. Like
+// setScript it returns the replaced value if it was a manifest.
+var setLeaseScript = redis.NewScript(2, `
+-- rcache:set-lease
+if redis.call("GET", KEYS[2]) ~= ARGV[1] then
+	return {0}
+end
+redis.call("DEL", KEYS[2])
+local old = false
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	old = redis.call("GET", KEYS[1])
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+if old and string.sub(old, 1, 4) == ARGV[4] then
+	return {1, old}
+end
+return {1}
+`)
+
+func (c *Cache) leaseTimeout() time.Duration {
+	if c.LeaseTimeout > 0 {
+		return c.LeaseTimeout
+	}
+	return defaultLeaseTimeout
+}
+
+// GetLease is like Get, but on a miss it also returns a lease token if no
+// other caller holds a lease for key. The holder of the lease should load the
+// value and store it with SetLeased. Deleting the key invalidates outstanding
+// leases, so a value loaded before the deletion is never cached.
+func (c *Cache) GetLease(key string, object interface{}) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", errors.Wrap(err, "newToken failed")
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return "", errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(getLeaseScript.Do(conn, key, leaseKey(key), token, int64(c.leaseTimeout()/time.Millisecond)))
+	if err != nil {
+		return "", errors.Wrap(err, "Redis lease script failed")
+	}
+	hit, _ := redis.Bool(reply[0], nil)
+	if !hit {
+		atomic.AddUint64(&c.misses, 1)
+		lease, _ := redis.String(reply[1], nil)
+		return lease, ErrCacheMiss
+	}
+
+	v, err := redis.Bytes(reply[1], nil)
+	if err == nil {
+		v, _, err = c.resolve(conn, key, v)
+	}
+	if err == redis.ErrNil {
+		atomic.AddUint64(&c.misses, 1)
+		return "", ErrCacheMiss
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Redis GET failed")
+	}
+	atomic.AddUint64(&c.hits, 1)
+	b, _ := decode(v)
+	return "", c.unmarshal(b, object)
+}
+
+// SetLeased stores item if lease is still valid and returns ErrLeaseInvalid
+// otherwise.
+func (c *Cache) SetLeased(item *Item, lease string) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	return c.setLeased(conn, item, lease)
+}
+
+func (c *Cache) setLeased(conn redis.Conn, item *Item, lease string) error {
+	b, err := c.marshal(item)
+	if err != nil {
+		return err
+	}
+	v := c.encode(b)
+	stored, err := c.writeChunks(conn, item.Key, v, item.Expiration)
+	if err != nil {
+		return err
+	}
+	reply, err := redis.Values(setLeaseScript.Do(conn, item.Key, leaseKey(item.Key), lease, stored, milliseconds(item.Expiration), manifestMagic))
+	if err != nil {
+		return errors.Wrap(err, "Redis lease script failed")
+	}
+	if ok, _ := redis.Bool(reply[0], nil); !ok {
+		if m, ok := parseManifest(stored); ok {
+			if err := c.deleteChunks(conn, item.Key, m); err != nil {
+				return err
+			}
+		}
+		return ErrLeaseInvalid
+	}
+	c.setLocal(item.Key, v, item.Expiration)
+	if len(reply) > 1 {
+		if err := c.deleteReplaced(conn, item.Key, reply[1]); err != nil {
+			return err
+		}
+	}
+	return c.mirrorSet(item.Key, b, item.Expiration)
+}
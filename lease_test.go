@@ -0,0 +1,18 @@
+package rcache
+
+import "testing"
+
+func TestReservedKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"user:1", "{user:1}:rcache-lease"},
+		{"{user:1}:profile", "{user:1}:profile:rcache-lease"},
+		{"a{b", "{a{b}:rcache-lease"},
+	}
+	for _, tt := range tests {
+		if got := reservedKey(tt.key, "lease"); got != tt.want {
+			t.Errorf("reservedKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
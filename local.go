@@ -0,0 +1,250 @@
+package rcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LocalCache is an in-process tier consulted before Redis. It holds values as
+// stored in Redis, so that they are unmarshalled on every hit. Deletes made
+// by other processes are not seen by the tier, its entries are kept for at
+// most Cache.LocalTTL.
+type LocalCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+const (
+	defaultLocalTTL = time.Minute
+	defaultDiskTTL  = 10 * time.Minute
+	// noExpiry is the remaining TTL of keys without expiration, which are
+	// kept for the TTL of each tier.
+	noExpiry = time.Duration(1<<63 - 1)
+)
+
+func (c *Cache) localTTL() time.Duration {
+	if c.LocalTTL > 0 {
+		return c.LocalTTL
+	}
+	return defaultLocalTTL
+}
+
+func (c *Cache) diskTTL() time.Duration {
+	if c.DiskTTL > 0 {
+		return c.DiskTTL
+	}
+	return defaultDiskTTL
+}
+
+// getLocal looks key up in the in-process tier and then in the disk tier.
+func (c *Cache) getLocal(key string) ([]byte, bool) {
+	if c.Local != nil {
+		if v, ok := c.Local.Get(key); ok {
+			return v, true
+		}
+	}
+	if c.Disk != nil {
+		if disk, ok := c.Disk.(interface {
+			GetTTL(key string) ([]byte, time.Duration, bool)
+		}); ok {
+			v, ttl, ok := disk.GetTTL(key)
+			if ok && c.Local != nil {
+				if ttl == 0 {
+					ttl = noExpiry
+				}
+				c.Local.Set(key, v, minDuration(c.localTTL(), ttl))
+			}
+			return v, ok
+		}
+		if v, ok := c.Disk.Get(key); ok {
+			if c.Local != nil {
+				c.Local.Set(key, v, c.localTTL())
+			}
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// setLocal stores v, written to Redis with expire, in the local tiers.
+func (c *Cache) setLocal(key string, v []byte, expire time.Duration) {
+	c.cacheLocal(key, v, expiration(expire))
+}
+
+// cacheLocal stores v in the local tiers for at most ttl, the remaining TTL
+// of the key in Redis.
+func (c *Cache) cacheLocal(key string, v []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if c.Local != nil {
+		c.Local.Set(key, v, minDuration(c.localTTL(), ttl))
+	}
+	if c.Disk != nil {
+		c.Disk.Set(key, v, minDuration(c.diskTTL(), ttl))
+	}
+}
+
+func (c *Cache) deleteLocal(key string) {
+	if c.Local != nil {
+		c.Local.Delete(key)
+	}
+	if c.Disk != nil {
+		c.Disk.Delete(key)
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// CostFunc returns the cost of an entry counted against the maximum cost of
+// a local cache.
+type CostFunc func(key string, value []byte) int64
+
+// entryOverhead approximates the memory used by an entry besides its key and
+// value.
+const entryOverhead = 64
+
+func defaultCost(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + entryOverhead
+}
+
+type localEntry struct {
+	key     string
+	value   []byte
+	cost    int64
+	expires time.Time
+	segment *segment
+	elem    *list.Element
+}
+
+func (e *localEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// segment is an LRU list of entries bounded by total cost. The front of the
+// list is the most recently used entry.
+type segment struct {
+	list    list.List
+	cost    int64
+	maxCost int64
+}
+
+func (s *segment) pushFront(e *localEntry) {
+	e.segment = s
+	e.elem = s.list.PushFront(e)
+	s.cost += e.cost
+}
+
+func (s *segment) remove(e *localEntry) {
+	s.list.Remove(e.elem)
+	s.cost -= e.cost
+	e.segment = nil
+	e.elem = nil
+}
+
+func (s *segment) back() *localEntry {
+	if elem := s.list.Back(); elem != nil {
+		return elem.Value.(*localEntry)
+	}
+	return nil
+}
+
+func (s *segment) overflows() bool {
+	return s.cost > s.maxCost
+}
+
+// LRU is a LocalCache evicting the least recently used entries once their
+// total cost exceeds the maximum.
+type LRU struct {
+	// Cost defaults to the size of key and value plus a fixed overhead.
+	Cost CostFunc
+
+	mu      sync.Mutex
+	entries map[string]*localEntry
+	lru     segment
+}
+
+func NewLRU(maxCost int64) *LRU {
+	return &LRU{
+		entries: make(map[string]*localEntry),
+		lru:     segment{maxCost: maxCost},
+	}
+}
+
+func (l *LRU) Get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		l.remove(e)
+		return nil, false
+	}
+	l.lru.list.MoveToFront(e.elem)
+	return e.value, true
+}
+
+func (l *LRU) Set(key string, value []byte, ttl time.Duration) {
+	e := newLocalEntry(l.Cost, key, value, ttl)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.entries[key]; ok {
+		l.remove(old)
+	}
+	if e.cost > l.lru.maxCost {
+		return
+	}
+	l.entries[key] = e
+	l.lru.pushFront(e)
+	for l.lru.overflows() {
+		l.remove(l.lru.back())
+	}
+}
+
+func (l *LRU) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.remove(e)
+	}
+}
+
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Purge removes all entries.
+func (l *LRU) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = make(map[string]*localEntry)
+	l.lru.list.Init()
+	l.lru.cost = 0
+}
+
+func (l *LRU) remove(e *localEntry) {
+	e.segment.remove(e)
+	delete(l.entries, e.key)
+}
+
+func newLocalEntry(cost CostFunc, key string, value []byte, ttl time.Duration) *localEntry {
+	if cost == nil {
+		cost = defaultCost
+	}
+	e := &localEntry{key: key, value: value, cost: cost(key, value)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	return e
+}
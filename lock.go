@@ -0,0 +1,62 @@
+package rcache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var unlockScript = redis.NewScript(1, `
+-- rcache:unlock
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// lock acquires the Redis lock key for ttl. It returns the token needed to
+// release the lock and false if the lock is held by someone else.
+func (c *Cache) lock(key string, ttl time.Duration) (string, bool, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", false, errors.Wrap(err, "newToken failed")
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return "", false, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	_, err = redis.String(conn.Do("SET", key, token, "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrap(err, "Redis SET failed")
+	}
+	return token, true, nil
+}
+
+func (c *Cache) unlock(key, token string) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if _, err := unlockScript.Do(conn, key, token); err != nil {
+		return errors.Wrap(err, "Redis unlock script failed")
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+// Package memcache provides the Cache API of rcache on top of memcached,
+// using its text protocol.
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrCacheMiss is the same error as rcache.ErrCacheMiss.
+	ErrCacheMiss = rcache.ErrCacheMiss
+	// ErrCASConflict is returned by CompareAndSwap when the value was
+	// modified since it was read.
+	ErrCASConflict = errors.New("memcache: compare-and-swap conflict")
+	// ErrUnsupported is returned by operations memcached has no equivalent
+	// for, such as scanning keys.
+	ErrUnsupported = errors.New("memcache: operation not supported")
+	ErrInvalidKey  = errors.New("memcache: invalid key")
+)
+
+const (
+	defaultTimeout = 3 * time.Second
+	defaultMaxIdle = 2
+	// Expirations longer than 30 days are sent as Unix timestamps.
+	maxRelativeExpiration = 30 * 24 * time.Hour
+)
+
+type Cache struct {
+	Addr      string
+	Marshal   rcache.MarshalFunc
+	Unmarshal rcache.UnmarshalFunc
+	// Timeout bounds dialing and each operation, 3 seconds by default.
+	Timeout time.Duration
+	// MaxIdle is the number of idle connections kept open, 2 by default.
+	MaxIdle int
+
+	hits   uint64
+	misses uint64
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+type Item struct {
+	Key    string
+	Object interface{}
+	// Value is stored as is instead of marshalling Object if it is not nil.
+	Value      []byte
+	Expiration time.Duration
+	// CAS is set by GetItem and GetMulti and checked by CompareAndSwap.
+	CAS uint64
+}
+
+func New(addr string, marshalFunc rcache.MarshalFunc, unmarshalFunc rcache.UnmarshalFunc) *Cache {
+	return &Cache{
+		Addr:      addr,
+		Marshal:   marshalFunc,
+		Unmarshal: unmarshalFunc,
+	}
+}
+
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+func (c *Cache) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+func (c *Cache) getConn() (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", c.Addr, c.timeout())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}, nil
+}
+
+func (c *Cache) putConn(cn *conn) {
+	maxIdle := c.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+	c.mu.Lock()
+	if len(c.idle) < maxIdle {
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+	if cn != nil {
+		cn.nc.Close()
+	}
+}
+
+// do runs fn on a connection. The connection is reused unless fn failed in a
+// way that may leave unread replies.
+func (c *Cache) do(fn func(*conn) error) error {
+	cn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	if err := cn.nc.SetDeadline(time.Now().Add(c.timeout())); err != nil {
+		cn.nc.Close()
+		return errors.WithStack(err)
+	}
+	err = fn(cn)
+	if err == nil || err == ErrCacheMiss || err == ErrCASConflict {
+		c.putConn(cn)
+	} else {
+		cn.nc.Close()
+	}
+	return err
+}
+
+// Close closes the idle connections.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+	for _, cn := range idle {
+		cn.nc.Close()
+	}
+	return nil
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// exptime converts d to memcached's expiration time, following rcache in
+// treating expirations under a second as 2 minutes.
+func exptime(d time.Duration) int64 {
+	if d < time.Second {
+		d = 2 * time.Minute
+	}
+	if d > maxRelativeExpiration {
+		return time.Now().Add(d).Unix()
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+func (c *Cache) marshal(item *Item) ([]byte, error) {
+	if item.Value != nil {
+		return item.Value, nil
+	}
+	b, err := c.Marshal(item.Object)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal failed")
+	}
+	return b, nil
+}
+
+func (c *Cache) unmarshal(b []byte, object interface{}) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if err := c.Unmarshal(b, object); err != nil {
+		return errors.Wrap(err, "unmarshal failed")
+	}
+	return nil
+}
+
+func (c *Cache) Set(item *Item) error {
+	return c.SetMulti(item)
+}
+
+// SetMulti pipelines the writes of items.
+func (c *Cache) SetMulti(items ...*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		if !validKey(item.Key) {
+			return errors.Wrapf(ErrInvalidKey, "item %q", item.Key)
+		}
+		b, err := c.marshal(item)
+		if err != nil {
+			return errors.Wrapf(err, "item %q", item.Key)
+		}
+		values[i] = b
+	}
+	err := c.do(func(cn *conn) error {
+		for i, item := range items {
+			cn.writeStore("set", item.Key, values[i], exptime(item.Expiration), 0)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+		for range items {
+			line, err := cn.readLine()
+			if err != nil {
+				return err
+			}
+			if line != "STORED" {
+				return errors.Errorf("memcache: unexpected reply %q", line)
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "memcached set failed")
+}
+
+// CompareAndSwap stores item if the value was not modified since item was
+// returned by GetItem or GetMulti. It returns ErrCASConflict if it was, and
+// ErrCacheMiss if it was deleted or expired.
+func (c *Cache) CompareAndSwap(item *Item) error {
+	if !validKey(item.Key) {
+		return ErrInvalidKey
+	}
+	b, err := c.marshal(item)
+	if err != nil {
+		return err
+	}
+	err = c.do(func(cn *conn) error {
+		cn.writeStore("cas", item.Key, b, exptime(item.Expiration), item.CAS)
+		if err := cn.rw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			return nil
+		case "EXISTS":
+			return ErrCASConflict
+		case "NOT_FOUND":
+			return ErrCacheMiss
+		}
+		return errors.Errorf("memcache: unexpected reply %q", line)
+	})
+	if err == ErrCASConflict || err == ErrCacheMiss {
+		return err
+	}
+	return errors.Wrap(err, "memcached cas failed")
+}
+
+func (c *Cache) Get(key string, object interface{}) error {
+	item, err := c.GetItem(key)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(item.Value, object)
+}
+
+// GetItem returns the raw value of key along with its CAS value.
+func (c *Cache) GetItem(key string) (*Item, error) {
+	items, err := c.GetMulti([]string{key})
+	if err != nil {
+		return nil, err
+	}
+	item, ok := items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return item, nil
+}
+
+// GetMulti returns the raw values of the keys found, with their CAS values,
+// in a single round trip.
+func (c *Cache) GetMulti(keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !validKey(key) {
+			return nil, errors.Wrapf(ErrInvalidKey, "key %q", key)
+		}
+	}
+	items := make(map[string]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+	err := c.do(func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "gets %s\r\n", strings.Join(keys, " "))
+		if err := cn.rw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+		return cn.readValues(func(item *Item) {
+			items[item.Key] = item
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "memcached gets failed")
+	}
+	atomic.AddUint64(&c.hits, uint64(len(items)))
+	atomic.AddUint64(&c.misses, uint64(len(keys)-len(items)))
+	return items, nil
+}
+
+// SetBytes stores b under key without marshalling it.
+func (c *Cache) SetBytes(key string, b []byte, expiration time.Duration) error {
+	if b == nil {
+		b = []byte{}
+	}
+	return c.Set(&Item{Key: key, Value: b, Expiration: expiration})
+}
+
+// GetBytes returns the raw value of key without unmarshalling it.
+func (c *Cache) GetBytes(key string) ([]byte, error) {
+	item, err := c.GetItem(key)
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// Delete deletes key, deleting a missing key is not an error.
+func (c *Cache) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	err := c.do(func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "delete %s\r\n", key)
+		if err := cn.rw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return errors.Errorf("memcache: unexpected reply %q", line)
+		}
+		return nil
+	})
+	return errors.Wrap(err, "memcached delete failed")
+}
+
+// Touch resets the expiration of key, it returns ErrCacheMiss if key does
+// not exist.
+func (c *Cache) Touch(key string, expiration time.Duration) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	err := c.do(func(cn *conn) error {
+		fmt.Fprintf(cn.rw, "touch %s %d\r\n", key, exptime(expiration))
+		if err := cn.rw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "TOUCHED":
+			return nil
+		case "NOT_FOUND":
+			return ErrCacheMiss
+		}
+		return errors.Errorf("memcache: unexpected reply %q", line)
+	})
+	if err == ErrCacheMiss {
+		return err
+	}
+	return errors.Wrap(err, "memcached touch failed")
+}
+
+// Scan is not supported by memcached, which cannot list keys.
+func (c *Cache) Scan(pattern string, fn func(key string) error) error {
+	return ErrUnsupported
+}
+
+func (c *Cache) Stats() *rcache.Stats {
+	return &rcache.Stats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+func (cn *conn) writeStore(verb, key string, value []byte, exptime int64, cas uint64) {
+	fmt.Fprintf(cn.rw, "%s %s 0 %d %d", verb, key, exptime, len(value))
+	if verb == "cas" {
+		fmt.Fprintf(cn.rw, " %d", cas)
+	}
+	cn.rw.WriteString("\r\n")
+	cn.rw.Write(value)
+	cn.rw.WriteString("\r\n")
+}
+
+// readLine reads a reply line, returning error replies as errors.
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.rw.ReadString('\n')
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch {
+	case line == "ERROR":
+		return "", errors.New("memcache: unknown command")
+	case strings.HasPrefix(line, "CLIENT_ERROR "):
+		return "", errors.Errorf("memcache: client error: %s", line[len("CLIENT_ERROR "):])
+	case strings.HasPrefix(line, "SERVER_ERROR "):
+		return "", errors.Errorf("memcache: server error: %s", line[len("SERVER_ERROR "):])
+	}
+	return line, nil
+}
+
+// readValues reads the VALUE lines of a gets reply up to END.
+func (cn *conn) readValues(fn func(*Item)) error {
+	for {
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[0] != "VALUE" {
+			return errors.Errorf("memcache: unexpected reply %q", line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return errors.Errorf("memcache: unexpected reply %q", line)
+		}
+		cas, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return errors.Errorf("memcache: unexpected reply %q", line)
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(cn.rw, value); err != nil {
+			return errors.WithStack(err)
+		}
+		if !bytes.HasSuffix(value, []byte("\r\n")) {
+			return errors.New("memcache: corrupt value")
+		}
+		fn(&Item{Key: fields[1], Value: value[:size], CAS: cas})
+	}
+}
@@ -0,0 +1,392 @@
+package memcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeItem struct {
+	value   []byte
+	cas     uint64
+	exptime int64
+}
+
+// fakeServer is a memcached stand-in speaking the subset of the text
+// protocol used by Cache. Values larger than maxValue are rejected with
+// SERVER_ERROR like memcached does, and replies registered in raw are sent
+// instead of the regular ones.
+type fakeServer struct {
+	addr     string
+	maxValue int
+
+	mu    sync.Mutex
+	items map[string]*fakeItem
+	cas   uint64
+	raw   map[string]string
+	conns int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeServer{
+		addr:     ln.Addr().String(),
+		maxValue: 1024,
+		items:    make(map[string]*fakeItem),
+		raw:      make(map[string]string),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			io.WriteString(conn, "ERROR\r\n")
+			continue
+		}
+
+		var value []byte
+		if fields[0] == "set" || fields[0] == "cas" {
+			size, err := strconv.Atoi(fields[4])
+			if err != nil {
+				io.WriteString(conn, "CLIENT_ERROR bad command line format\r\n")
+				return
+			}
+			value = make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			value = value[:size]
+		}
+
+		s.mu.Lock()
+		reply, ok := s.raw[line]
+		if !ok {
+			reply = s.handle(fields, value)
+		}
+		s.mu.Unlock()
+		io.WriteString(conn, reply)
+	}
+}
+
+func (s *fakeServer) handle(fields []string, value []byte) string {
+	switch fields[0] {
+	case "get", "gets":
+		var b strings.Builder
+		for _, key := range fields[1:] {
+			item, ok := s.items[key]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(&b, "VALUE %s 0 %d", key, len(item.value))
+			if fields[0] == "gets" {
+				fmt.Fprintf(&b, " %d", item.cas)
+			}
+			fmt.Fprintf(&b, "\r\n%s\r\n", item.value)
+		}
+		return b.String() + "END\r\n"
+	case "set", "cas":
+		if len(value) > s.maxValue {
+			return "SERVER_ERROR object too large for cache\r\n"
+		}
+		exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+		key := fields[1]
+		if fields[0] == "cas" {
+			item, ok := s.items[key]
+			if !ok {
+				return "NOT_FOUND\r\n"
+			}
+			if cas, _ := strconv.ParseUint(fields[5], 10, 64); cas != item.cas {
+				return "EXISTS\r\n"
+			}
+		}
+		s.cas++
+		s.items[key] = &fakeItem{value: value, cas: s.cas, exptime: exptime}
+		return "STORED\r\n"
+	case "delete":
+		if _, ok := s.items[fields[1]]; !ok {
+			return "NOT_FOUND\r\n"
+		}
+		delete(s.items, fields[1])
+		return "DELETED\r\n"
+	case "touch":
+		item, ok := s.items[fields[1]]
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		item.exptime, _ = strconv.ParseInt(fields[2], 10, 64)
+		return "TOUCHED\r\n"
+	}
+	return "ERROR\r\n"
+}
+
+func (s *fakeServer) item(key string) *fakeItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[key]
+}
+
+// reply makes the server answer line with reply.
+func (s *fakeServer) reply(line, reply string) {
+	s.mu.Lock()
+	s.raw[line] = reply
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func newTestCache(t *testing.T) (*Cache, *fakeServer) {
+	s := newFakeServer(t)
+	c := New(s.addr, json.Marshal, json.Unmarshal)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+	return c, s
+}
+
+func TestGet(t *testing.T) {
+	c, s := newTestCache(t)
+
+	var got string
+	if err := c.Get("missing", &got); err != ErrCacheMiss {
+		t.Fatalf("Get(missing) = %v, want ErrCacheMiss", err)
+	}
+	if err := c.Set(&Item{Key: "k", Object: "v", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get("k", &got); err != nil || got != "v" {
+		t.Fatalf("Get(k) = %q, %v", got, err)
+	}
+	if item := s.item("k"); item == nil || item.exptime != 60 {
+		t.Errorf("stored item = %+v, want exptime 60", item)
+	}
+
+	if err := c.SetBytes("raw", []byte("a\r\nb"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := c.GetBytes("raw"); err != nil || string(b) != "a\r\nb" {
+		t.Errorf("GetBytes(raw) = %q, %v", b, err)
+	}
+	if err := c.SetBytes("empty", nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := c.GetBytes("empty"); err != nil || len(b) != 0 {
+		t.Errorf("GetBytes(empty) = %q, %v", b, err)
+	}
+
+	if err := c.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("k"); err != nil {
+		t.Errorf("Delete of a missing key failed: %v", err)
+	}
+	if err := c.Get("k", &got); err != ErrCacheMiss {
+		t.Errorf("Get after Delete = %v, want ErrCacheMiss", err)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 {
+		t.Errorf("Stats() = %d hits, %d misses, want 3 and 2", stats.Hits, stats.Misses)
+	}
+	if n := s.dials(); n != 1 {
+		t.Errorf("server accepted %d connections, want 1", n)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	err := c.SetMulti(
+		&Item{Key: "a", Value: []byte("1")},
+		&Item{Key: "b", Value: []byte("22")},
+		&Item{Key: "c", Value: []byte("333")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.GetMulti([]string{"a", "missing", "c", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("GetMulti returned %d items, want 3", len(items))
+	}
+	for key, want := range map[string]string{"a": "1", "b": "22", "c": "333"} {
+		item := items[key]
+		if item == nil || string(item.Value) != want || item.Key != key {
+			t.Errorf("items[%q] = %+v, want %q", key, item, want)
+		}
+	}
+	if items["a"].CAS == items["b"].CAS {
+		t.Errorf("a and b share the CAS value %d", items["a"].CAS)
+	}
+
+	if items, err := c.GetMulti(nil); err != nil || len(items) != 0 {
+		t.Errorf("GetMulti(nil) = %v, %v", items, err)
+	}
+	if _, err := c.GetMulti([]string{"a", "bad key"}); err == nil {
+		t.Error("GetMulti with an invalid key succeeded")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	if err := c.Set(&Item{Key: "k", Object: 1}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.GetItem("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *item
+
+	item.Value = nil
+	item.Object = 2
+	if err := c.CompareAndSwap(item); err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	stale.Value = []byte("3")
+	if err := c.CompareAndSwap(&stale); err != ErrCASConflict {
+		t.Errorf("CompareAndSwap of a stale item = %v, want ErrCASConflict", err)
+	}
+	var got int
+	if err := c.Get("k", &got); err != nil || got != 2 {
+		t.Errorf("Get(k) = %d, %v, want 2", got, err)
+	}
+
+	if err := c.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CompareAndSwap(item); err != ErrCacheMiss {
+		t.Errorf("CompareAndSwap of a deleted item = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c, s := newTestCache(t)
+
+	if err := c.Touch("k", time.Minute); err != ErrCacheMiss {
+		t.Errorf("Touch(missing) = %v, want ErrCacheMiss", err)
+	}
+	if err := c.SetBytes("k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Touch("k", 40*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Expirations over 30 days are absolute.
+	if item := s.item("k"); item.exptime < time.Now().Unix() {
+		t.Errorf("exptime = %d, want a Unix timestamp", item.exptime)
+	}
+	if err := c.Touch("k", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if item := s.item("k"); item.exptime != 120 {
+		t.Errorf("exptime = %d, want 120", item.exptime)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, s := newTestCache(t)
+
+	for _, key := range []string{"", "a b", "a\nb", strings.Repeat("k", 251)} {
+		if err := c.SetBytes(key, []byte("v"), 0); err == nil {
+			t.Errorf("SetBytes(%q) succeeded", key)
+		}
+		if err := c.Delete(key); err != ErrInvalidKey {
+			t.Errorf("Delete(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	if err := c.SetBytes("big", make([]byte, 2000), 0); err == nil ||
+		!strings.Contains(err.Error(), "server error: object too large for cache") {
+		t.Errorf("SetBytes of a large value = %v", err)
+	}
+
+	s.reply("touch k 120", "CLIENT_ERROR bad command line format\r\n")
+	if err := c.Touch("k", 0); err == nil || !strings.Contains(err.Error(), "client error: bad command line format") {
+		t.Errorf("Touch = %v, want a client error", err)
+	}
+	s.reply("delete k", "CLIENT_ERROR bad data chunk\r\n")
+	if err := c.Delete("k"); err == nil || !strings.Contains(err.Error(), "client error: bad data chunk") {
+		t.Errorf("Delete = %v, want a client error", err)
+	}
+	s.reply("gets k", "CLIENT_ERROR line too long\r\n")
+	if _, err := c.GetItem("k"); err == nil || !strings.Contains(err.Error(), "client error: line too long") {
+		t.Errorf("GetItem = %v, want a client error", err)
+	}
+	s.reply("gets unknown", "ERROR\r\n")
+	if _, err := c.GetItem("unknown"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("GetItem = %v, want an unknown command error", err)
+	}
+
+	// Malformed gets replies.
+	for key, reply := range map[string]string{
+		"short":   "VALUE short 0 1\r\nv\r\nEND\r\n",
+		"size":    "VALUE size 0 x 1\r\nv\r\nEND\r\n",
+		"cas":     "VALUE cas 0 1 x\r\nv\r\nEND\r\n",
+		"corrupt": "VALUE corrupt 0 1 1\r\nvv\r\nEND\r\n",
+		"stored":  "STORED\r\n",
+	} {
+		s.reply("gets "+key, reply)
+		if _, err := c.GetItem(key); err == nil {
+			t.Errorf("GetItem(%q) succeeded on %q", key, reply)
+		}
+	}
+
+	// Failed connections are closed, so that the next operation dials
+	// again and does not read the rest of a reply.
+	dials := s.dials()
+	if err := c.SetBytes("ok", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := c.GetBytes("ok"); err != nil || string(b) != "v" {
+		t.Errorf("GetBytes(ok) = %q, %v", b, err)
+	}
+	if n := s.dials(); n != dials+1 {
+		t.Errorf("server accepted %d connections, want %d", n, dials+1)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, _ := newTestCache(t)
+	if err := c.Scan("*", func(string) error { return nil }); err != ErrUnsupported {
+		t.Errorf("Scan = %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,107 @@
+package rcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+// Values stored with StoreMetadata enabled start with headerMagic followed by
+// the time they were stored at in Unix milliseconds.
+var headerMagic = []byte{0xff, 'r', 'c', 1}
+
+// reservedPrefix starts both headerMagic and manifestMagic. Values starting
+// with it are always stored with a header, so that they are never mistaken
+// for a header or a manifest when read back.
+var reservedPrefix = headerMagic[:3]
+
+const headerSize = 12
+
+func (c *Cache) encode(b []byte) []byte {
+	if !c.StoreMetadata && !bytes.HasPrefix(b, reservedPrefix) {
+		return b
+	}
+	v := make([]byte, headerSize+len(b))
+	copy(v, headerMagic)
+	binary.BigEndian.PutUint64(v[len(headerMagic):], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(v[headerSize:], b)
+	return v
+}
+
+// decode strips the metadata header from v. Values without header are
+// returned unchanged with a zero time.
+func decode(v []byte) ([]byte, time.Time) {
+	if len(v) < headerSize || !bytes.HasPrefix(v, headerMagic) {
+		return v, time.Time{}
+	}
+	ms := int64(binary.BigEndian.Uint64(v[len(headerMagic):]))
+	return v[headerSize:], time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// GetItem is like Get but also returns the raw payload, the remaining TTL
+// and the payload size of the entry. StoredAt and Expiration are only known
+// for values written with StoreMetadata enabled. object may be nil to only
+// read the payload.
+func (c *Cache) GetItem(key string, object interface{}) (*Item, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if err := conn.Send("GET", key); err != nil {
+		return nil, errors.Wrap(err, "Redis GET failed")
+	}
+	if err := conn.Send("PTTL", key); err != nil {
+		return nil, errors.Wrap(err, "Redis PTTL failed")
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis GET failed")
+	}
+	v, err := redis.Bytes(replies[0], nil)
+	if err != nil {
+		if err == redis.ErrNil {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, ErrCacheMiss
+		}
+		return nil, errors.Wrap(err, "Redis GET failed")
+	}
+	pttl, err := redis.Int64(replies[1], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis PTTL failed")
+	}
+	v, _, err = c.resolve(conn, key, v)
+	if err != nil {
+		if err == redis.ErrNil {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, ErrCacheMiss
+		}
+		return nil, errors.Wrap(err, "Redis GET failed")
+	}
+	atomic.AddUint64(&c.hits, 1)
+
+	b, storedAt := decode(v)
+	item := &Item{
+		Key:      key,
+		Object:   object,
+		Value:    b,
+		StoredAt: storedAt,
+		Size:     len(b),
+	}
+	if pttl > 0 {
+		item.TTL = time.Duration(pttl) * time.Millisecond
+		if !storedAt.IsZero() {
+			item.Expiration = time.Since(storedAt) + item.TTL
+		}
+	}
+	if object != nil {
+		if err := c.unmarshal(b, object); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
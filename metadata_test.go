@@ -0,0 +1,37 @@
+package rcache_test
+
+import (
+	"bytes"
+	"encoding/json"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/lcd1232/redis-cache/rcachetest"
+	"testing"
+	"time"
+)
+
+// Raw values looking like a metadata header or a manifest must be read back
+// as they were written.
+func TestReservedPrefix(t *testing.T) {
+	values := [][]byte{
+		{0xff, 'r', 'c', 1, 0, 0, 1, 0x80, 0, 0, 0, 0, 'x'},
+		append([]byte{0xff, 'r', 'c', 'm'}, `{"id":"x","chunks":1,"size":1,"crc32":0}`...),
+		{0xff, 'r', 'c'},
+	}
+	for _, metadata := range []bool{false, true} {
+		c := rcache.NewRedisCache(rcachetest.NewFake(), json.Marshal, json.Unmarshal)
+		c.StoreMetadata = metadata
+		for _, v := range values {
+			if err := c.SetBytes("k", v, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			b, err := c.GetBytes("k")
+			if err != nil || !bytes.Equal(b, v) {
+				t.Errorf("StoreMetadata=%v: GetBytes = %q, %v, want %q", metadata, b, err, v)
+			}
+			item, err := c.GetItem("k", nil)
+			if err != nil || !bytes.Equal(item.Value, v) {
+				t.Errorf("StoreMetadata=%v: GetItem = %q, %v, want %q", metadata, item.Value, err, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package rcache
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const migrateBatch = 100
+
+// migrateKey copies key, with its chunks, from MigrateFrom unless it was set
+// in the meantime, and returns its value like getValue.
+func (c *Cache) migrateKey(conn redis.Conn, key string) ([]byte, time.Duration, error) {
+	old := c.MigrateFrom.Get()
+	defer old.Close()
+
+	v, ttl, err := c.getWithTTL(old, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, m, err := c.resolve(old, key, v)
+	if err != nil {
+		return nil, 0, err
+	}
+	var keys []string
+	if m != nil {
+		for i := 0; i < m.Chunks; i++ {
+			keys = append(keys, m.chunkKey(key, i))
+		}
+	}
+	// The manifest goes last, so that it is never found without its chunks.
+	keys = append(keys, key)
+	if _, _, err := copyKeys(old, conn, keys); err != nil {
+		return nil, 0, errors.Wrap(err, "migration failed")
+	}
+	return b, ttl, nil
+}
+
+// copyKeys copies keys with their remaining TTLs, and keeps the keys that
+// exist already.
+func copyKeys(from, to redis.Conn, keys []string) (copied, skipped int, err error) {
+	for _, key := range keys {
+		if err := from.Send("DUMP", key); err != nil {
+			return 0, 0, errors.Wrap(err, "Redis DUMP failed")
+		}
+		if err := from.Send("PTTL", key); err != nil {
+			return 0, 0, errors.Wrap(err, "Redis PTTL failed")
+		}
+	}
+	replies, err := redis.Values(from.Do(""))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Redis DUMP failed")
+	}
+
+	var restored []string
+	for i, key := range keys {
+		payload, err := redis.Bytes(replies[2*i], nil)
+		if err == redis.ErrNil {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "Redis DUMP failed")
+		}
+		pttl, err := redis.Int64(replies[2*i+1], nil)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "Redis PTTL failed")
+		}
+		if pttl == -2 {
+			skipped++
+			continue
+		}
+		if pttl < 0 {
+			pttl = 0
+		}
+		if err := to.Send("RESTORE", key, pttl, payload); err != nil {
+			return 0, 0, errors.Wrap(err, "Redis RESTORE failed")
+		}
+		restored = append(restored, key)
+	}
+	if len(restored) == 0 {
+		return 0, skipped, nil
+	}
+	replies, err = redis.Values(to.Do(""))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Redis RESTORE failed")
+	}
+	for i, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			if strings.HasPrefix(string(err), "BUSYKEY") {
+				skipped++
+				continue
+			}
+			return copied, skipped, errors.Wrapf(err, "Redis RESTORE of %q failed", restored[i])
+		}
+		copied++
+	}
+	return copied, skipped, nil
+}
+
+func (c *Cache) mirrorSet(key string, b []byte, expire time.Duration) error {
+	if c.MigrateFrom == nil {
+		return nil
+	}
+	conn := c.MigrateFrom.Get()
+	defer conn.Close()
+	return errors.Wrap(c.setValue(conn, key, b, expire), "migration source")
+}
+
+func (c *Cache) mirrorDelete(key string) error {
+	if c.MigrateFrom == nil {
+		return nil
+	}
+	conn := c.MigrateFrom.Get()
+	defer conn.Close()
+	return errors.Wrap(c.delValue(conn, key), "migration source")
+}
+
+// mirrorStream copies a value written by SetStream from conn to MigrateFrom
+// one chunk at a time, since it may not fit in memory. Chunks are copied with
+// GET and SET rather than DUMP, whose payloads an older Redis may reject.
+func (c *Cache) mirrorStream(conn redis.Conn, key string, m *manifest, expire time.Duration) error {
+	if c.MigrateFrom == nil {
+		return nil
+	}
+	old := c.MigrateFrom.Get()
+	defer old.Close()
+
+	ttl := milliseconds(expire) + int64(chunkGrace/time.Millisecond)
+	for i := 0; i < m.Chunks; i++ {
+		b, err := redis.Bytes(conn.Do("GET", m.chunkKey(key, i)))
+		if err != nil {
+			return errors.Wrap(err, "Redis GET failed")
+		}
+		if _, err := old.Do("SET", m.chunkKey(key, i), b, "PX", ttl); err != nil {
+			c.deleteChunks(old, key, m)
+			return errors.Wrap(err, "migration source: Redis SET failed")
+		}
+	}
+	reply, err := setScript.Do(old, key, m.encode(), milliseconds(expire), manifestMagic)
+	if err != nil {
+		c.deleteChunks(old, key, m)
+		return errors.Wrap(err, "migration source: Redis SET failed")
+	}
+	if reply != nil {
+		if err := c.deleteReplaced(old, key, reply); err != nil {
+			return errors.Wrap(err, "migration source: Redis DEL failed")
+		}
+	}
+	return nil
+}
+
+type MigrateProgress struct {
+	Scanned uint64
+	Copied  uint64
+	// Skipped counts keys that existed already, expired before they could
+	// be copied, or are kept by the cache for itself, such as leases.
+	Skipped uint64
+}
+
+// Migrator copies the keys of Cache.MigrateFrom to Cache.Redis. Keys that
+// exist already are kept, so it can run while the cache is used and be
+// restarted after a failure. Values are copied with DUMP and RESTORE, which
+// requires the new deployment to run a Redis version at least as recent.
+// Leases, locks and the queues of write-behind and invalidations are left
+// behind, only the chunks of values are copied among the internal keys.
+type Migrator struct {
+	Cache *Cache
+	// Pattern selects the keys to copy, all keys by default.
+	Pattern string
+	// RateLimit is the most keys copied per second, unlimited if 0.
+	RateLimit int
+
+	Progress func(MigrateProgress)
+}
+
+// Run copies the keys and returns once the old deployment was scanned or ctx
+// is done.
+func (m *Migrator) Run(ctx context.Context) (MigrateProgress, error) {
+	var progress MigrateProgress
+	c := m.Cache
+	if c.MigrateFrom == nil {
+		return progress, errors.New("Cache.MigrateFrom is not set")
+	}
+	pattern := m.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	old := c.MigrateFrom.Get()
+	defer old.Close()
+	conn, err := c.getConn()
+	if err != nil {
+		return progress, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	err = scan(old, pattern, func(page []string) error {
+		var keys []string
+		for _, key := range page {
+			if c.internal(key) && !chunkKeyPattern.MatchString(key) {
+				progress.Scanned++
+				progress.Skipped++
+				continue
+			}
+			keys = append(keys, key)
+		}
+		for len(keys) > 0 {
+			batch := keys
+			if len(batch) > migrateBatch {
+				batch = batch[:migrateBatch]
+			}
+			keys = keys[len(batch):]
+
+			start := time.Now()
+			copied, skipped, err := copyKeys(old, conn, batch)
+			progress.Scanned += uint64(len(batch))
+			progress.Copied += uint64(copied)
+			progress.Skipped += uint64(skipped)
+			if m.Progress != nil {
+				m.Progress(progress)
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if m.RateLimit > 0 {
+				wait := time.Second*time.Duration(len(batch))/time.Duration(m.RateLimit) - time.Since(start)
+				if wait > 0 {
+					timer := time.NewTimer(wait)
+					select {
+					case <-ctx.Done():
+						timer.Stop()
+						return ctx.Err()
+					case <-timer.C:
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return progress, err
+}
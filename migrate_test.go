@@ -0,0 +1,58 @@
+package rcache_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/lcd1232/redis-cache/rcachetest"
+	"testing"
+	"time"
+)
+
+func TestMigrateFromUnavailable(t *testing.T) {
+	c := rcache.NewRedisCache(rcachetest.NewFake(), json.Marshal, json.Unmarshal)
+	c.MigrateFrom = &redis.Pool{Dial: func() (redis.Conn, error) {
+		return nil, errors.New("unavailable")
+	}}
+	var handled []error
+	c.ErrorHandler = func(err error) { handled = append(handled, err) }
+
+	if _, err := get(t, c, "k"); err != rcache.ErrCacheMiss {
+		t.Errorf("Get = %v, want ErrCacheMiss", err)
+	}
+	if len(handled) != 1 {
+		t.Errorf("ErrorHandler received %v, want the migration error", handled)
+	}
+}
+
+func TestMigratorSkipsInternalKeys(t *testing.T) {
+	oldPool := rcachetest.NewFake()
+	old := rcache.NewRedisCache(oldPool, json.Marshal, json.Unmarshal)
+	old.ChunkSize = 4
+	if err := old.Set(&rcache.Item{Key: "chunked", Object: "a long value", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.GetLease("leased", nil); err != rcache.ErrCacheMiss {
+		t.Fatal(err)
+	}
+
+	pool := rcachetest.NewFake()
+	c := rcache.NewRedisCache(pool, json.Marshal, json.Unmarshal)
+	c.MigrateFrom = oldPool
+	progress, err := (&rcache.Migrator{Cache: c}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Skipped != 1 {
+		t.Errorf("Migrator skipped %d keys, want the lease only", progress.Skipped)
+	}
+	c.MigrateFrom = nil
+	if s, err := get(t, c, "chunked"); err != nil || s != "a long value" {
+		t.Errorf("Get(chunked) = %q, %v", s, err)
+	}
+	if lease, _ := c.GetLease("leased", nil); lease == "" {
+		t.Errorf("the lease of the old deployment was copied")
+	}
+}
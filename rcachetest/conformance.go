@@ -0,0 +1,420 @@
+// Package rcachetest checks that a connection pool behaves like Redis for
+// Cache, and provides an in-memory Fake pool for tests.
+//
+// A backend is verified from a test of its own package:
+//
+//	func TestConformance(t *testing.T) {
+//		rcachetest.RunConformance(t, func(t *testing.T) rcache.Pool {
+//			return &goredis.Pool{Client: newClient(t)}
+//		})
+//	}
+package rcachetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Factory returns a pool for an empty database. It is called once for each
+// test of the suite, which may delete any key.
+type Factory func(t *testing.T) rcache.Pool
+
+type conformanceTest struct {
+	name string
+	fn   func(t *testing.T, c *rcache.Cache)
+}
+
+var conformanceTests = []conformanceTest{
+	{"SetGet", testSetGet},
+	{"Miss", testMiss},
+	{"EmptyValue", testEmptyValue},
+	{"Delete", testDelete},
+	{"TTL", testTTL},
+	{"Expiry", testExpiry},
+	{"Sliding", testSliding},
+	{"SetMulti", testSetMulti},
+	{"Chunks", testChunks},
+	{"Take", testTake},
+	{"Lease", testLease},
+	{"Scan", testScan},
+	{"ExportImport", testExportImport},
+	{"Pipeline", testPipeline},
+	{"Transaction", testTransaction},
+	{"Script", testScript},
+	{"Errors", testErrors},
+}
+
+// RunConformance runs the suite against pools returned by factory, each test
+// as a subtest.
+func RunConformance(t *testing.T, factory Factory) {
+	for _, tt := range conformanceTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := rcache.NewRedisCache(factory(t), json.Marshal, json.Unmarshal)
+			defer c.Close()
+			tt.fn(t, c)
+		})
+	}
+}
+
+type object struct {
+	Str string
+	Num int
+}
+
+func set(t *testing.T, c *rcache.Cache, key string, v interface{}, expiration time.Duration) {
+	t.Helper()
+	if err := c.Set(&rcache.Item{Key: key, Object: v, Expiration: expiration}); err != nil {
+		t.Fatalf("Set(%q) failed: %v", key, err)
+	}
+}
+
+func get(t *testing.T, c *rcache.Cache, key string, want interface{}) {
+	t.Helper()
+	got := reflect.New(reflect.TypeOf(want))
+	if err := c.Get(key, got.Interface()); err != nil {
+		t.Fatalf("Get(%q) failed: %v", key, err)
+	}
+	if !reflect.DeepEqual(got.Elem().Interface(), want) {
+		t.Fatalf("Get(%q) = %v, want %v", key, got.Elem().Interface(), want)
+	}
+}
+
+func miss(t *testing.T, c *rcache.Cache, key string) {
+	t.Helper()
+	var v interface{}
+	if err := c.Get(key, &v); err != rcache.ErrCacheMiss {
+		t.Fatalf("Get(%q) = %v, want ErrCacheMiss", key, err)
+	}
+}
+
+func do(t *testing.T, c *rcache.Cache, cmd string, args ...interface{}) (interface{}, error) {
+	t.Helper()
+	conn := c.Redis.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+func testSetGet(t *testing.T, c *rcache.Cache) {
+	set(t, c, "key", object{Str: "a", Num: 1}, time.Minute)
+	get(t, c, "key", object{Str: "a", Num: 1})
+	set(t, c, "key", object{Str: "b", Num: 2}, time.Minute)
+	get(t, c, "key", object{Str: "b", Num: 2})
+}
+
+func testMiss(t *testing.T, c *rcache.Cache) {
+	miss(t, c, "missing")
+	if _, err := c.GetBytes("missing"); err != rcache.ErrCacheMiss {
+		t.Fatalf("GetBytes = %v, want ErrCacheMiss", err)
+	}
+	if _, err := c.GetItem("missing", nil); err != rcache.ErrCacheMiss {
+		t.Fatalf("GetItem = %v, want ErrCacheMiss", err)
+	}
+	if s := c.Stats(); s.Misses != 3 || s.Hits != 0 {
+		t.Fatalf("Stats = %+v, want 3 misses", s)
+	}
+}
+
+func testEmptyValue(t *testing.T, c *rcache.Cache) {
+	if err := c.SetBytes("key", nil, time.Minute); err != nil {
+		t.Fatalf("SetBytes failed: %v", err)
+	}
+	b, err := c.GetBytes("key")
+	if err != nil {
+		t.Fatalf("GetBytes failed: %v", err)
+	}
+	if b == nil || len(b) != 0 {
+		t.Fatalf("GetBytes = %q, want empty value", b)
+	}
+}
+
+func testDelete(t *testing.T, c *rcache.Cache) {
+	set(t, c, "key", "value", time.Minute)
+	if err := c.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	miss(t, c, "key")
+	if err := c.Delete("key"); err != nil {
+		t.Fatalf("Delete of a missing key failed: %v", err)
+	}
+}
+
+func testTTL(t *testing.T, c *rcache.Cache) {
+	c.StoreMetadata = true
+	before := time.Now().Truncate(time.Millisecond)
+	set(t, c, "key", "value", 10*time.Second)
+	var v string
+	item, err := c.GetItem("key", &v)
+	if err != nil {
+		t.Fatalf("GetItem failed: %v", err)
+	}
+	if v != "value" {
+		t.Fatalf("GetItem value = %q, want %q", v, "value")
+	}
+	if item.TTL <= 9*time.Second || item.TTL > 10*time.Second {
+		t.Fatalf("GetItem TTL = %v, want about 10s", item.TTL)
+	}
+	if item.StoredAt.Before(before) || item.StoredAt.After(time.Now()) {
+		t.Fatalf("GetItem StoredAt = %v, want about %v", item.StoredAt, before)
+	}
+
+	// Expirations under a second default to 2 minutes.
+	set(t, c, "default", "value", 0)
+	ttl, err := redis.Int64(do(t, c, "PTTL", "default"))
+	if err != nil {
+		t.Fatalf("PTTL failed: %v", err)
+	}
+	if ttl <= int64(119*time.Second/time.Millisecond) || ttl > int64(2*time.Minute/time.Millisecond) {
+		t.Fatalf("PTTL = %dms, want about 2 minutes", ttl)
+	}
+}
+
+func testExpiry(t *testing.T, c *rcache.Cache) {
+	set(t, c, "key", "value", time.Second)
+	get(t, c, "key", "value")
+	time.Sleep(1100 * time.Millisecond)
+	miss(t, c, "key")
+}
+
+func testSliding(t *testing.T, c *rcache.Cache) {
+	set(t, c, "key", "value", time.Second)
+	var v string
+	if err := c.Get("key", &v, rcache.Sliding(time.Minute)); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	get(t, c, "key", "value")
+}
+
+func testSetMulti(t *testing.T, c *rcache.Cache) {
+	err := c.SetMulti(
+		&rcache.Item{Key: "a", Object: 1, Expiration: time.Minute},
+		&rcache.Item{Key: "b", Object: 2, Expiration: time.Minute},
+		&rcache.Item{Key: "c", Value: []byte("3"), Expiration: time.Minute},
+	)
+	if err != nil {
+		t.Fatalf("SetMulti failed: %v", err)
+	}
+	get(t, c, "a", 1)
+	get(t, c, "b", 2)
+	get(t, c, "c", 3)
+}
+
+func testChunks(t *testing.T, c *rcache.Cache) {
+	c.ChunkSize = 16
+	long := strings.Repeat("0123456789", 10)
+	set(t, c, "key", long, time.Minute)
+	get(t, c, "key", long)
+
+	set(t, c, "key", "short", time.Minute)
+	get(t, c, "key", "short")
+
+	set(t, c, "key", long, time.Minute)
+	if err := c.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	miss(t, c, "key")
+}
+
+func testTake(t *testing.T, c *rcache.Cache) {
+	set(t, c, "key", "value", time.Minute)
+	var v string
+	if err := c.Take("key", &v); err != nil {
+		t.Fatalf("Take failed: %v", err)
+	}
+	if v != "value" {
+		t.Fatalf("Take = %q, want %q", v, "value")
+	}
+	if err := c.Take("key", &v); err != rcache.ErrCacheMiss {
+		t.Fatalf("second Take = %v, want ErrCacheMiss", err)
+	}
+}
+
+func testLease(t *testing.T, c *rcache.Cache) {
+	var v string
+	lease, err := c.GetLease("key", &v)
+	if err != rcache.ErrCacheMiss || lease == "" {
+		t.Fatalf("GetLease = %q, %v, want a lease and ErrCacheMiss", lease, err)
+	}
+	if other, err := c.GetLease("key", &v); err != rcache.ErrCacheMiss || other != "" {
+		t.Fatalf("second GetLease = %q, %v, want no lease and ErrCacheMiss", other, err)
+	}
+	if err := c.SetLeased(&rcache.Item{Key: "key", Object: "value", Expiration: time.Minute}, "stale"); err != rcache.ErrLeaseInvalid {
+		t.Fatalf("SetLeased with a wrong lease = %v, want ErrLeaseInvalid", err)
+	}
+	if err := c.SetLeased(&rcache.Item{Key: "key", Object: "value", Expiration: time.Minute}, lease); err != nil {
+		t.Fatalf("SetLeased failed: %v", err)
+	}
+	if lease, err := c.GetLease("key", &v); err != nil || lease != "" || v != "value" {
+		t.Fatalf("GetLease = %q, %q, %v, want the value", lease, v, err)
+	}
+
+	// Deleting the key invalidates the lease.
+	if err := c.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	lease, _ = c.GetLease("key", &v)
+	if err := c.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := c.SetLeased(&rcache.Item{Key: "key", Object: "value", Expiration: time.Minute}, lease); err != rcache.ErrLeaseInvalid {
+		t.Fatalf("SetLeased after Delete = %v, want ErrLeaseInvalid", err)
+	}
+}
+
+func testScan(t *testing.T, c *rcache.Cache) {
+	for _, key := range []string{"user:1", "user:2", "user:10", "order:1"} {
+		set(t, c, key, key, time.Minute)
+	}
+	found := make(map[string]bool)
+	err := c.Scan("user:?", func(key string) error {
+		found[key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if want := map[string]bool{"user:1": true, "user:2": true}; !reflect.DeepEqual(found, want) {
+		t.Fatalf("Scan found %v, want %v", found, want)
+	}
+}
+
+func testExportImport(t *testing.T, c *rcache.Cache) {
+	set(t, c, "user:1", "a", time.Minute)
+	set(t, c, "user:2", "b", time.Minute)
+	set(t, c, "order:1", "c", time.Minute)
+	var buf bytes.Buffer
+	n, err := c.Export(context.Background(), "user:*", &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Export = %d, %v, want 2 keys", n, err)
+	}
+	c.Delete("user:1")
+	set(t, c, "user:2", "changed", time.Minute)
+
+	export := buf.Bytes()
+	result, err := c.Import(context.Background(), bytes.NewReader(export), rcache.ImportOptions{SkipExisting: true})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Restored != 1 || result.Skipped != 1 {
+		t.Fatalf("Import = %+v, want 1 restored and 1 skipped", result)
+	}
+	get(t, c, "user:1", "a")
+	get(t, c, "user:2", "changed")
+	item, err := c.GetItem("user:1", nil)
+	if err != nil || item.TTL <= 50*time.Second {
+		t.Fatalf("GetItem = %+v, %v, want the exported TTL", item, err)
+	}
+
+	if _, err := c.Import(context.Background(), bytes.NewReader(export), rcache.ImportOptions{}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	get(t, c, "user:2", "b")
+
+	_, err = c.Import(context.Background(), bytes.NewReader(export[:len(export)-1]), rcache.ImportOptions{})
+	if err != rcache.ErrInvalidExport {
+		t.Fatalf("Import of a truncated export = %v, want ErrInvalidExport", err)
+	}
+}
+
+func testPipeline(t *testing.T, c *rcache.Cache) {
+	conn := c.Redis.Get()
+	defer conn.Close()
+	conn.Send("SET", "key", "value")
+	conn.Send("GET", "key")
+	conn.Send("GET", "missing")
+	conn.Send("UNKNOWN-COMMAND")
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("pipeline returned %d replies, want 4", len(replies))
+	}
+	if s, err := redis.String(replies[0], nil); err != nil || s != "OK" {
+		t.Fatalf("SET reply = %v, want OK", replies[0])
+	}
+	if b, err := redis.Bytes(replies[1], nil); err != nil || !bytes.Equal(b, []byte("value")) {
+		t.Fatalf("GET reply = %v, want value", replies[1])
+	}
+	if replies[2] != nil {
+		t.Fatalf("GET of a missing key = %v, want nil", replies[2])
+	}
+	if _, ok := replies[3].(redis.Error); !ok {
+		t.Fatalf("unknown command reply = %#v, want redis.Error", replies[3])
+	}
+
+	// Receive reads the replies of sent commands one by one.
+	conn.Send("SET", "key", "other")
+	conn.Send("GET", "key")
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if _, err := conn.Receive(); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if s, err := redis.String(conn.Receive()); err != nil || s != "other" {
+		t.Fatalf("Receive = %q, %v, want other", s, err)
+	}
+}
+
+func testTransaction(t *testing.T, c *rcache.Cache) {
+	conn := c.Redis.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SET", "key", "value", "PX", 60000)
+	conn.Send("GET", "key")
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		t.Fatalf("EXEC failed: %v", err)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("EXEC returned %d replies, want 2", len(replies))
+	}
+	if s, err := redis.String(replies[1], nil); err != nil || s != "value" {
+		t.Fatalf("GET in transaction = %v, want value", replies[1])
+	}
+}
+
+func testScript(t *testing.T, c *rcache.Cache) {
+	// Scripts are run with EVALSHA, falling back to EVAL on NOSCRIPT. The
+	// Fake emulates them, so this only tests the Lua code against Redis.
+	_, err := do(t, c, "EVALSHA", strings.Repeat("0", 40), 0)
+	if e, ok := err.(redis.Error); !ok || !strings.HasPrefix(string(e), "NOSCRIPT ") {
+		t.Fatalf("EVALSHA of an unknown script = %v, want a NOSCRIPT error", err)
+	}
+	// Lock, refresh and lease scripts share this path.
+	lease, _ := c.GetLease("key", nil)
+	if lease == "" {
+		t.Fatalf("GetLease returned no lease")
+	}
+	if err := c.SetLeased(&rcache.Item{Key: "key", Object: "value", Expiration: time.Minute}, lease); err != nil {
+		t.Fatalf("SetLeased failed: %v", err)
+	}
+	get(t, c, "key", "value")
+}
+
+func testErrors(t *testing.T, c *rcache.Cache) {
+	if _, err := redis.Bytes(do(t, c, "GET", "missing")); err != redis.ErrNil {
+		t.Fatalf("GET of a missing key = %v, want redis.ErrNil", err)
+	}
+	if _, err := do(t, c, "UNKNOWN-COMMAND"); err == nil {
+		t.Fatalf("unknown command succeeded")
+	} else if _, ok := err.(redis.Error); !ok {
+		t.Fatalf("unknown command error = %#v, want redis.Error", err)
+	}
+	if _, err := do(t, c, "SET", "key"); err == nil {
+		t.Fatalf("SET with a missing argument succeeded")
+	}
+	ttl, err := redis.Int64(do(t, c, "PTTL", "missing"))
+	if err != nil || ttl != -2 {
+		t.Fatalf("PTTL of a missing key = %d, %v, want -2", ttl, err)
+	}
+}
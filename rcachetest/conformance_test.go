@@ -0,0 +1,32 @@
+package rcachetest
+
+import (
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"os"
+	"testing"
+)
+
+// TestRedigoConformance runs against the Redis server at REDIS_ADDR, whose
+// database 15 is flushed before each test. Unlike the Fake, it runs the Lua
+// scripts of Cache.
+func TestRedigoConformance(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	RunConformance(t, func(t *testing.T) rcache.Pool {
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, redis.DialDatabase(15))
+			},
+		}
+		t.Cleanup(func() { pool.Close() })
+		conn := pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("FLUSHDB"); err != nil {
+			t.Fatalf("FLUSHDB failed: %v", err)
+		}
+		return pool
+	})
+}
@@ -0,0 +1,763 @@
+package rcachetest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory rcache.Pool implementing the string, hash and stream
+// commands used by Cache, MULTI/EXEC and its scripts. Scripts are not
+// interpreted, they are recognized by their first line, "-- rcache:<name>",
+// and emulated, so only a conformance run against Redis checks the scripts
+// themselves. Sorted sets are not supported, so neither are idempotency and
+// InvalidateAfterWrite.
+type Fake struct {
+	mu      sync.Mutex
+	data    map[string]*fakeEntry
+	scripts map[string]string
+}
+
+// fakeEntry holds a string value, or a hash or a stream if either is set.
+type fakeEntry struct {
+	value   []byte
+	hash    map[string][]byte
+	stream  *fakeStream
+	expires time.Time
+}
+
+func (e *fakeEntry) typ() string {
+	switch {
+	case e.hash != nil:
+		return "hash"
+	case e.stream != nil:
+		return "stream"
+	}
+	return "string"
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		data:    make(map[string]*fakeEntry),
+		scripts: make(map[string]string),
+	}
+}
+
+func (f *Fake) Get() redis.Conn {
+	return &fakeConn{f: f}
+}
+
+// fakeConn runs commands as they are sent and queues their replies.
+type fakeConn struct {
+	f       *Fake
+	replies []interface{}
+	multi   [][][]byte
+	inMulti bool
+	closed  bool
+}
+
+var errClosed = redis.Error("rcachetest: connection closed")
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	if c.closed {
+		return errClosed
+	}
+	return nil
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	if c.closed {
+		return errClosed
+	}
+	c.replies = append(c.replies, c.exec(cmd, args))
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	return c.Err()
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	if len(c.replies) == 0 {
+		return nil, redis.Error("rcachetest: no pending reply")
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	if cmd != "" {
+		c.replies = append(c.replies, c.exec(cmd, args))
+	}
+	replies := c.replies
+	c.replies = nil
+	if cmd == "" {
+		if len(replies) == 0 {
+			return nil, nil
+		}
+		return replies, nil
+	}
+	var err error
+	for _, reply := range replies {
+		if e, ok := reply.(redis.Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+func (c *fakeConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.Do(cmd, args...)
+}
+
+func (c *fakeConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.Receive()
+}
+
+func (c *fakeConn) exec(cmd string, args []interface{}) interface{} {
+	argv := make([][]byte, 0, len(args)+1)
+	argv = append(argv, []byte(strings.ToUpper(cmd)))
+	for _, arg := range args {
+		argv = append(argv, argBytes(arg))
+	}
+
+	switch name := string(argv[0]); {
+	case name == "MULTI":
+		if c.inMulti {
+			return redis.Error("ERR MULTI calls can not be nested")
+		}
+		c.inMulti = true
+		return "OK"
+	case name == "DISCARD":
+		c.inMulti, c.multi = false, nil
+		return "OK"
+	case name == "EXEC":
+		if !c.inMulti {
+			return redis.Error("ERR EXEC without MULTI")
+		}
+		c.f.mu.Lock()
+		defer c.f.mu.Unlock()
+		replies := make([]interface{}, len(c.multi))
+		for i, argv := range c.multi {
+			replies[i] = c.f.call(argv)
+		}
+		c.inMulti, c.multi = false, nil
+		return replies
+	case c.inMulti:
+		c.multi = append(c.multi, argv)
+		return "QUEUED"
+	}
+	block, ok := blockTimeout(argv)
+	deadline := time.Now().Add(block)
+	for {
+		c.f.mu.Lock()
+		reply := c.f.call(argv)
+		c.f.mu.Unlock()
+		if reply != nil || !ok || !time.Now().Before(deadline) {
+			return reply
+		}
+		time.Sleep(fakeBlockPoll)
+	}
+}
+
+// fakeBlockPoll is how often blocking reads look for new entries.
+const fakeBlockPoll = 5 * time.Millisecond
+
+// blockTimeout returns the BLOCK option of XREADGROUP, 0 meaning no limit.
+func blockTimeout(argv [][]byte) (time.Duration, bool) {
+	if string(argv[0]) != "XREADGROUP" {
+		return 0, false
+	}
+	for i := 1; i+1 < len(argv); i++ {
+		switch strings.ToUpper(string(argv[i])) {
+		case "STREAMS":
+			return 0, false
+		case "BLOCK":
+			ms, err := strconv.ParseInt(string(argv[i+1]), 10, 64)
+			if err != nil || ms < 0 {
+				return 0, false
+			}
+			if ms == 0 {
+				return time.Duration(1<<63 - 1), true
+			}
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+func argBytes(arg interface{}) []byte {
+	switch arg := arg.(type) {
+	case []byte:
+		return arg
+	case string:
+		return []byte(arg)
+	case int:
+		return []byte(strconv.Itoa(arg))
+	case int64:
+		return []byte(strconv.FormatInt(arg, 10))
+	case float64:
+		return []byte(strconv.FormatFloat(arg, 'g', -1, 64))
+	case bool:
+		if arg {
+			return []byte("1")
+		}
+		return []byte("0")
+	case nil:
+		return []byte{}
+	case redis.Argument:
+		return argBytes(arg.RedisArg())
+	}
+	return []byte(fmt.Sprint(arg))
+}
+
+func errArgs(name string) redis.Error {
+	return redis.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+var (
+	errSyntax    = redis.Error("ERR syntax error")
+	errInteger   = redis.Error("ERR value is not an integer or out of range")
+	errWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// lookup returns the live entry of key, deleting it if it expired.
+func (f *Fake) lookup(key string) *fakeEntry {
+	e, ok := f.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(f.data, key)
+		return nil
+	}
+	return e
+}
+
+func (f *Fake) get(key string) interface{} {
+	e := f.lookup(key)
+	switch {
+	case e == nil:
+		return nil
+	case e.typ() != "string":
+		return errWrongType
+	}
+	return e.value
+}
+
+func (f *Fake) set(key string, value []byte, ttl time.Duration) {
+	e := &fakeEntry{value: append([]byte{}, value...)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	f.data[key] = e
+}
+
+func (f *Fake) del(keys ...[]byte) int64 {
+	var n int64
+	for _, key := range keys {
+		if f.lookup(string(key)) != nil {
+			delete(f.data, string(key))
+			n++
+		}
+	}
+	return n
+}
+
+func parseMillis(b []byte, unit time.Duration) (time.Duration, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// call runs a command with f.mu held.
+func (f *Fake) call(argv [][]byte) interface{} {
+	name, args := string(argv[0]), argv[1:]
+	arity := map[string]int{
+		"GET": 1, "SETEX": 3, "TYPE": 1, "PEXPIRE": 2, "EXPIRE": 2, "PTTL": 1, "TTL": 1,
+		"GETDEL": 1, "PERSIST": 1,
+	}
+	if n, ok := arity[name]; ok && len(args) != n {
+		return errArgs(name)
+	}
+
+	switch name {
+	case "PING":
+		return "PONG"
+	case "INFO":
+		return []byte("# Server\r\nredis_version:7.2.0\r\n")
+	case "SELECT", "AUTH":
+		return "OK"
+	case "FLUSHDB", "FLUSHALL":
+		f.data = make(map[string]*fakeEntry)
+		return "OK"
+	case "GET":
+		return f.get(string(args[0]))
+	case "MGET":
+		if len(args) == 0 {
+			return errArgs(name)
+		}
+		replies := make([]interface{}, len(args))
+		for i, key := range args {
+			replies[i] = f.get(string(key))
+		}
+		return replies
+	case "SET":
+		return f.setCommand(args)
+	case "SETEX":
+		ttl, ok := parseMillis(args[1], time.Second)
+		if !ok {
+			return redis.Error("ERR invalid expire time in 'setex' command")
+		}
+		f.set(string(args[0]), args[2], ttl)
+		return "OK"
+	case "DEL":
+		if len(args) == 0 {
+			return errArgs(name)
+		}
+		return f.del(args...)
+	case "EXISTS":
+		if len(args) == 0 {
+			return errArgs(name)
+		}
+		var n int64
+		for _, key := range args {
+			if f.lookup(string(key)) != nil {
+				n++
+			}
+		}
+		return n
+	case "TYPE":
+		if e := f.lookup(string(args[0])); e != nil {
+			return e.typ()
+		}
+		return "none"
+	case "PEXPIRE", "EXPIRE":
+		unit := time.Millisecond
+		if name == "EXPIRE" {
+			unit = time.Second
+		}
+		n, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return errInteger
+		}
+		e := f.lookup(string(args[0]))
+		if e == nil {
+			return int64(0)
+		}
+		if n <= 0 {
+			delete(f.data, string(args[0]))
+			return int64(1)
+		}
+		e.expires = time.Now().Add(time.Duration(n) * unit)
+		return int64(1)
+	case "PERSIST":
+		e := f.lookup(string(args[0]))
+		if e == nil || e.expires.IsZero() {
+			return int64(0)
+		}
+		e.expires = time.Time{}
+		return int64(1)
+	case "PTTL", "TTL":
+		e := f.lookup(string(args[0]))
+		switch {
+		case e == nil:
+			return int64(-2)
+		case e.expires.IsZero():
+			return int64(-1)
+		}
+		ttl := time.Until(e.expires)
+		if name == "TTL" {
+			return int64((ttl + time.Second/2) / time.Second)
+		}
+		return int64((ttl + time.Millisecond/2) / time.Millisecond)
+	case "GETDEL":
+		v := f.get(string(args[0]))
+		delete(f.data, string(args[0]))
+		return v
+	case "GETEX":
+		return f.getexCommand(args)
+	case "SCAN":
+		return f.scanCommand(args)
+	case "DUMP":
+		if len(args) != 1 {
+			return errArgs(name)
+		}
+		e := f.lookup(string(args[0]))
+		switch {
+		case e == nil:
+			return nil
+		case e.typ() != "string":
+			return redis.Error("ERR rcachetest: DUMP only supports strings")
+		}
+		return append([]byte(fakeDumpPrefix), e.value...)
+	case "RESTORE":
+		return f.restoreCommand(args)
+	case "EVAL", "EVALSHA":
+		return f.eval(name, args)
+	case "SCRIPT":
+		if len(args) == 2 && strings.ToUpper(string(args[0])) == "LOAD" {
+			return []byte(f.loadScript(args[1]))
+		}
+		return redis.Error("ERR unsupported SCRIPT subcommand")
+	case "HSET", "HGET", "HMGET", "HDEL", "HGETALL", "HLEN":
+		return f.hashCommand(name, args)
+	case "XADD", "XGROUP", "XREADGROUP", "XACK", "XDEL", "XRANGE", "XLEN", "XPENDING", "XCLAIM":
+		return f.streamCommand(name, args)
+	}
+	return redis.Error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+}
+
+func (f *Fake) setCommand(args [][]byte) interface{} {
+	if len(args) < 2 {
+		return errArgs("SET")
+	}
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "PX", "EX":
+			if i+1 == len(args) {
+				return errSyntax
+			}
+			unit := time.Millisecond
+			if opt == "EX" {
+				unit = time.Second
+			}
+			var ok bool
+			if ttl, ok = parseMillis(args[i+1], unit); !ok {
+				return redis.Error("ERR invalid expire time in 'set' command")
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	exists := f.lookup(string(args[0])) != nil
+	if nx && exists || xx && !exists {
+		return nil
+	}
+	f.set(string(args[0]), args[1], ttl)
+	return "OK"
+}
+
+// fakeDumpPrefix marks the payloads of DUMP, which are not compatible with
+// Redis.
+const fakeDumpPrefix = "rcachetest-dump:"
+
+func (f *Fake) restoreCommand(args [][]byte) interface{} {
+	if len(args) < 3 {
+		return errArgs("RESTORE")
+	}
+	replace := false
+	for _, opt := range args[3:] {
+		if strings.ToUpper(string(opt)) != "REPLACE" {
+			return errSyntax
+		}
+		replace = true
+	}
+	ms, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || ms < 0 {
+		return redis.Error("ERR Invalid TTL value, must be >= 0")
+	}
+	payload := string(args[2])
+	if !strings.HasPrefix(payload, fakeDumpPrefix) {
+		return redis.Error("ERR DUMP payload version or checksum are wrong")
+	}
+	if !replace && f.lookup(string(args[0])) != nil {
+		return redis.Error("BUSYKEY Target key name already exists.")
+	}
+	f.set(string(args[0]), []byte(payload[len(fakeDumpPrefix):]), time.Duration(ms)*time.Millisecond)
+	return "OK"
+}
+
+// scanCommand returns all matching keys at once, sorted for stable output.
+func (f *Fake) scanCommand(args [][]byte) interface{} {
+	if len(args) == 0 {
+		return errArgs("SCAN")
+	}
+	if _, err := strconv.ParseUint(string(args[0]), 10, 64); err != nil {
+		return redis.Error("ERR invalid cursor")
+	}
+	pattern := "*"
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+		default:
+			return errSyntax
+		}
+	}
+	var keys []string
+	for key := range f.data {
+		if f.lookup(key) != nil && matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	replies := make([]interface{}, len(keys))
+	for i, key := range keys {
+		replies[i] = []byte(key)
+	}
+	return []interface{}{[]byte("0"), replies}
+}
+
+// matchGlob implements the glob-style patterns of Redis: *, ?, [...] with
+// ranges and negation, and backslash escapes.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			match := false
+			for i := 0; i < len(class); i++ {
+				if class[i] == '\\' && i+1 < len(class) {
+					i++
+					match = match || class[i] == s[0]
+				} else if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || lo <= s[0] && s[0] <= hi
+					i += 2
+				} else {
+					match = match || class[i] == s[0]
+				}
+			}
+			if match == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (f *Fake) getexCommand(args [][]byte) interface{} {
+	if len(args) == 0 {
+		return errArgs("GETEX")
+	}
+	e := f.lookup(string(args[0]))
+	if e != nil && e.typ() != "string" {
+		return errWrongType
+	}
+	if len(args) == 1 {
+		return f.get(string(args[0]))
+	}
+	opt := strings.ToUpper(string(args[1]))
+	if opt == "PERSIST" && len(args) == 2 {
+		if e == nil {
+			return nil
+		}
+		e.expires = time.Time{}
+		return e.value
+	}
+	if (opt != "PX" && opt != "EX") || len(args) != 3 {
+		return errSyntax
+	}
+	unit := time.Millisecond
+	if opt == "EX" {
+		unit = time.Second
+	}
+	ttl, ok := parseMillis(args[2], unit)
+	if !ok {
+		return redis.Error("ERR invalid expire time in 'getex' command")
+	}
+	if e == nil {
+		return nil
+	}
+	e.expires = time.Now().Add(ttl)
+	return e.value
+}
+
+func (f *Fake) loadScript(src []byte) string {
+	sum := sha1.Sum(src)
+	sha := hex.EncodeToString(sum[:])
+	name := ""
+	for _, line := range strings.Split(string(src), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			name = strings.TrimPrefix(line, "-- rcache:")
+			break
+		}
+	}
+	f.scripts[sha] = name
+	return sha
+}
+
+func (f *Fake) eval(cmd string, args [][]byte) interface{} {
+	if len(args) < 2 {
+		return errArgs(cmd)
+	}
+	var name string
+	if cmd == "EVAL" {
+		name = f.scripts[f.loadScript(args[0])]
+	} else {
+		var ok bool
+		if name, ok = f.scripts[strings.ToLower(string(args[0]))]; !ok {
+			return redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	}
+	n, err := strconv.Atoi(string(args[1]))
+	if err != nil || n < 0 || n > len(args)-2 {
+		return redis.Error("ERR Number of keys can't be greater than number of args")
+	}
+	keys, argv := args[2:2+n], args[2+n:]
+	script, ok := fakeScripts[name]
+	if !ok {
+		return redis.Error(fmt.Sprintf("ERR rcachetest: script %q is not supported by the fake", name))
+	}
+	return script(f, keys, argv)
+}
+
+// fakeScripts emulate the scripts of rcache by name, keys and arguments
+// being passed as they are to EVAL.
+var fakeScripts = map[string]func(f *Fake, keys, argv [][]byte) interface{}{
+	"set": func(f *Fake, keys, argv [][]byte) interface{} {
+		old := f.get(string(keys[0]))
+		ttl, _ := parseMillis(argv[1], time.Millisecond)
+		f.set(string(keys[0]), argv[0], ttl)
+		return manifestOrNil(old, argv[2])
+	},
+	"del": func(f *Fake, keys, argv [][]byte) interface{} {
+		old := f.get(string(keys[0]))
+		f.del(keys[0], keys[1])
+		return manifestOrNil(old, argv[0])
+	},
+	"get-lease": func(f *Fake, keys, argv [][]byte) interface{} {
+		if v := f.get(string(keys[0])); v != nil {
+			return []interface{}{int64(1), v}
+		}
+		if f.lookup(string(keys[1])) != nil {
+			return []interface{}{int64(0), nil}
+		}
+		ttl, _ := parseMillis(argv[1], time.Millisecond)
+		f.set(string(keys[1]), argv[0], ttl)
+		return []interface{}{int64(0), argv[0]}
+	},
+	"set-lease": func(f *Fake, keys, argv [][]byte) interface{} {
+		lease, ok := f.get(string(keys[1])).([]byte)
+		if !ok || string(lease) != string(argv[0]) {
+			return []interface{}{int64(0)}
+		}
+		f.del(keys[1])
+		old := f.get(string(keys[0]))
+		ttl, _ := parseMillis(argv[2], time.Millisecond)
+		f.set(string(keys[0]), argv[1], ttl)
+		if m := manifestOrNil(old, argv[3]); m != nil {
+			return []interface{}{int64(1), m}
+		}
+		return []interface{}{int64(1)}
+	},
+	"unlock": func(f *Fake, keys, argv [][]byte) interface{} {
+		if v, ok := f.get(string(keys[0])).([]byte); ok && string(v) == string(argv[0]) {
+			return f.del(keys[0])
+		}
+		return int64(0)
+	},
+	"getdel": func(f *Fake, keys, argv [][]byte) interface{} {
+		v := f.get(string(keys[0]))
+		f.del(keys[0])
+		return v
+	},
+	"enqueue": func(f *Fake, keys, argv [][]byte) interface{} {
+		id := f.streamCommand("XADD", append([][]byte{keys[0], []byte("*")}, argv[1:]...))
+		if isError(id) {
+			return id
+		}
+		if reply := f.hashCommand("HSET", [][]byte{keys[1], argv[0], id.([]byte)}); isError(reply) {
+			return reply
+		}
+		return id
+	},
+	"clear-latest": func(f *Fake, keys, argv [][]byte) interface{} {
+		for i := 0; i+1 < len(argv); i += 2 {
+			id, ok := f.hashCommand("HGET", [][]byte{keys[0], argv[i]}).([]byte)
+			if ok && string(id) == string(argv[i+1]) {
+				f.hashCommand("HDEL", [][]byte{keys[0], argv[i]})
+			}
+		}
+		return int64(0)
+	},
+}
+
+func isError(reply interface{}) bool {
+	_, ok := reply.(redis.Error)
+	return ok
+}
+
+func manifestOrNil(old interface{}, magic []byte) interface{} {
+	if v, ok := old.([]byte); ok && strings.HasPrefix(string(v), string(magic)) {
+		return v
+	}
+	return nil
+}
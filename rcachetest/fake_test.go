@@ -0,0 +1,12 @@
+package rcachetest
+
+import (
+	rcache "github.com/lcd1232/redis-cache"
+	"testing"
+)
+
+func TestFakeConformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) rcache.Pool {
+		return NewFake()
+	})
+}
@@ -0,0 +1,503 @@
+package rcachetest
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collection returns the entry of key, creating it with create if it does
+// not exist and create is not nil. It returns false if key holds another type
+// than typ.
+func (f *Fake) collection(key, typ string, create func() *fakeEntry) (*fakeEntry, bool) {
+	e := f.lookup(key)
+	if e == nil {
+		if create == nil {
+			return nil, true
+		}
+		e = create()
+		f.data[key] = e
+	}
+	return e, e.typ() == typ
+}
+
+func newHash() *fakeEntry {
+	return &fakeEntry{hash: make(map[string][]byte)}
+}
+
+func (f *Fake) hashCommand(name string, args [][]byte) interface{} {
+	minArgs := map[string]int{"HSET": 3, "HGET": 2, "HMGET": 2, "HDEL": 2, "HGETALL": 1, "HLEN": 1}[name]
+	if len(args) < minArgs || (name == "HSET" && len(args)%2 != 1) ||
+		(name == "HGET" || name == "HGETALL" || name == "HLEN") && len(args) != minArgs {
+		return errArgs(name)
+	}
+	var create func() *fakeEntry
+	if name == "HSET" {
+		create = newHash
+	}
+	e, ok := f.collection(string(args[0]), "hash", create)
+	if !ok {
+		return errWrongType
+	}
+
+	switch name {
+	case "HSET":
+		var n int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := e.hash[string(args[i])]; !ok {
+				n++
+			}
+			e.hash[string(args[i])] = append([]byte{}, args[i+1]...)
+		}
+		return n
+	case "HGET":
+		if e == nil {
+			return nil
+		}
+		if v, ok := e.hash[string(args[1])]; ok {
+			return v
+		}
+		return nil
+	case "HMGET":
+		replies := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if e != nil {
+				if v, ok := e.hash[string(field)]; ok {
+					replies[i] = v
+				}
+			}
+		}
+		return replies
+	case "HDEL":
+		if e == nil {
+			return int64(0)
+		}
+		var n int64
+		for _, field := range args[1:] {
+			if _, ok := e.hash[string(field)]; ok {
+				delete(e.hash, string(field))
+				n++
+			}
+		}
+		if len(e.hash) == 0 {
+			delete(f.data, string(args[0]))
+		}
+		return n
+	case "HGETALL":
+		replies := []interface{}{}
+		if e != nil {
+			fields := make([]string, 0, len(e.hash))
+			for field := range e.hash {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				replies = append(replies, []byte(field), e.hash[field])
+			}
+		}
+		return replies
+	case "HLEN":
+		if e == nil {
+			return int64(0)
+		}
+		return int64(len(e.hash))
+	}
+	return nil
+}
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || id.ms == other.ms && id.seq < other.seq
+}
+
+// parseStreamID parses an ID or range bound. A bound without sequence
+// number covers the whole millisecond, so end selects its last sequence.
+func parseStreamID(b []byte, end bool) (streamID, bool) {
+	switch s := string(b); s {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{math.MaxUint64, math.MaxUint64}, true
+	}
+	parts := strings.SplitN(string(b), "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	id := streamID{ms: ms}
+	if len(parts) == 1 {
+		if end {
+			id.seq = math.MaxUint64
+		}
+		return id, true
+	}
+	if id.seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return streamID{}, false
+	}
+	return id, true
+}
+
+var errStreamID = redis.Error("ERR Invalid stream ID specified as stream command argument")
+
+type fakeStream struct {
+	entries []fakeStreamEntry
+	last    streamID
+	groups  map[string]*fakeGroup
+}
+
+type fakeStreamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+type fakeGroup struct {
+	delivered streamID
+	pending   map[streamID]*fakePending
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+func newStream() *fakeEntry {
+	return &fakeEntry{stream: &fakeStream{groups: make(map[string]*fakeGroup)}}
+}
+
+func (s *fakeStream) entry(id streamID) (fakeStreamEntry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].id.less(id) })
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+	return fakeStreamEntry{}, false
+}
+
+func (e fakeStreamEntry) reply() interface{} {
+	fields := make([]interface{}, len(e.fields))
+	for i, field := range e.fields {
+		fields[i] = field
+	}
+	return []interface{}{[]byte(e.id.String()), fields}
+}
+
+func (g *fakeGroup) pendingIDs() []streamID {
+	ids := make([]streamID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+func (f *Fake) streamCommand(name string, args [][]byte) interface{} {
+	switch name {
+	case "XADD":
+		return f.xadd(args)
+	case "XGROUP":
+		return f.xgroup(args)
+	case "XREADGROUP":
+		return f.xreadgroup(args)
+	}
+
+	minArgs := map[string]int{"XACK": 3, "XDEL": 2, "XRANGE": 3, "XLEN": 1, "XPENDING": 5, "XCLAIM": 5}[name]
+	if len(args) < minArgs {
+		return errArgs(name)
+	}
+	e, ok := f.collection(string(args[0]), "stream", nil)
+	if !ok {
+		return errWrongType
+	}
+	var s *fakeStream
+	if e != nil {
+		s = e.stream
+	}
+	var g *fakeGroup
+	if name == "XACK" || name == "XPENDING" || name == "XCLAIM" {
+		if s != nil {
+			g = s.groups[string(args[1])]
+		}
+		if g == nil {
+			if name == "XACK" {
+				return int64(0)
+			}
+			return redis.Error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", args[0], args[1]))
+		}
+	}
+
+	switch name {
+	case "XACK":
+		var n int64
+		for _, b := range args[2:] {
+			id, ok := parseStreamID(b, false)
+			if !ok {
+				return errStreamID
+			}
+			if _, ok := g.pending[id]; ok {
+				delete(g.pending, id)
+				n++
+			}
+		}
+		return n
+	case "XDEL":
+		if s == nil {
+			return int64(0)
+		}
+		var n int64
+		for _, b := range args[1:] {
+			id, ok := parseStreamID(b, false)
+			if !ok {
+				return errStreamID
+			}
+			for i, entry := range s.entries {
+				if entry.id == id {
+					s.entries = append(s.entries[:i], s.entries[i+1:]...)
+					n++
+					break
+				}
+			}
+		}
+		return n
+	case "XLEN":
+		if s == nil {
+			return int64(0)
+		}
+		return int64(len(s.entries))
+	case "XRANGE":
+		start, ok1 := parseStreamID(args[1], false)
+		end, ok2 := parseStreamID(args[2], true)
+		if !ok1 || !ok2 {
+			return errStreamID
+		}
+		count := -1
+		if len(args) == 5 && strings.ToUpper(string(args[3])) == "COUNT" {
+			n, err := strconv.Atoi(string(args[4]))
+			if err != nil {
+				return errInteger
+			}
+			count = n
+		} else if len(args) != 3 {
+			return errSyntax
+		}
+		replies := []interface{}{}
+		if s != nil {
+			for _, entry := range s.entries {
+				if count >= 0 && len(replies) == count {
+					break
+				}
+				if !entry.id.less(start) && !end.less(entry.id) {
+					replies = append(replies, entry.reply())
+				}
+			}
+		}
+		return replies
+	case "XPENDING":
+		// Only the extended form is supported.
+		start, ok1 := parseStreamID(args[2], false)
+		end, ok2 := parseStreamID(args[3], true)
+		if !ok1 || !ok2 {
+			return errStreamID
+		}
+		count, err := strconv.Atoi(string(args[4]))
+		if err != nil {
+			return errInteger
+		}
+		consumer := ""
+		if len(args) == 6 {
+			consumer = string(args[5])
+		} else if len(args) != 5 {
+			return errSyntax
+		}
+		replies := []interface{}{}
+		for _, id := range g.pendingIDs() {
+			p := g.pending[id]
+			if len(replies) == count || end.less(id) {
+				break
+			}
+			if id.less(start) || consumer != "" && p.consumer != consumer {
+				continue
+			}
+			idle := int64(time.Since(p.delivered) / time.Millisecond)
+			replies = append(replies, []interface{}{[]byte(id.String()), []byte(p.consumer), idle, p.count})
+		}
+		return replies
+	case "XCLAIM":
+		minIdle, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil {
+			return errInteger
+		}
+		replies := []interface{}{}
+		for _, b := range args[4:] {
+			id, ok := parseStreamID(b, false)
+			if !ok {
+				return errStreamID
+			}
+			p, ok := g.pending[id]
+			if !ok || time.Since(p.delivered) < time.Duration(minIdle)*time.Millisecond {
+				continue
+			}
+			entry, ok := s.entry(id)
+			if !ok {
+				// Like Redis 7, entries deleted from the stream are dropped.
+				delete(g.pending, id)
+				continue
+			}
+			p.consumer, p.delivered = string(args[2]), time.Now()
+			p.count++
+			replies = append(replies, entry.reply())
+		}
+		return replies
+	}
+	return nil
+}
+
+func (f *Fake) xadd(args [][]byte) interface{} {
+	if len(args) < 4 || len(args)%2 != 0 {
+		return errArgs("XADD")
+	}
+	if string(args[1]) != "*" {
+		return redis.Error("ERR rcachetest: XADD only supports generated IDs")
+	}
+	e, ok := f.collection(string(args[0]), "stream", newStream)
+	if !ok {
+		return errWrongType
+	}
+	s := e.stream
+	id := streamID{ms: uint64(time.Now().UnixNano() / int64(time.Millisecond))}
+	if !s.last.less(id) {
+		id = streamID{s.last.ms, s.last.seq + 1}
+	}
+	fields := make([][]byte, len(args)-2)
+	for i, field := range args[2:] {
+		fields[i] = append([]byte{}, field...)
+	}
+	s.entries = append(s.entries, fakeStreamEntry{id: id, fields: fields})
+	s.last = id
+	return []byte(id.String())
+}
+
+func (f *Fake) xgroup(args [][]byte) interface{} {
+	if len(args) < 4 || strings.ToUpper(string(args[0])) != "CREATE" {
+		return redis.Error("ERR rcachetest: only XGROUP CREATE is supported")
+	}
+	var create func() *fakeEntry
+	for _, opt := range args[4:] {
+		if strings.ToUpper(string(opt)) != "MKSTREAM" {
+			return errSyntax
+		}
+		create = newStream
+	}
+	e, ok := f.collection(string(args[1]), "stream", create)
+	if !ok {
+		return errWrongType
+	}
+	if e == nil {
+		return redis.Error("ERR The XGROUP subcommand requires the key to exist.")
+	}
+	s := e.stream
+	if _, ok := s.groups[string(args[2])]; ok {
+		return redis.Error("BUSYGROUP Consumer Group name already exists")
+	}
+	start := s.last
+	if string(args[3]) != "$" {
+		var ok bool
+		if start, ok = parseStreamID(args[3], false); !ok {
+			return errStreamID
+		}
+	}
+	s.groups[string(args[2])] = &fakeGroup{delivered: start, pending: make(map[streamID]*fakePending)}
+	return "OK"
+}
+
+// xreadgroup supports a single stream. Blocking is implemented by fakeConn,
+// which repeats the command while it returns nil.
+func (f *Fake) xreadgroup(args [][]byte) interface{} {
+	if len(args) < 6 || strings.ToUpper(string(args[0])) != "GROUP" {
+		return errSyntax
+	}
+	group, consumer := string(args[1]), string(args[2])
+	count := -1
+	var key, from []byte
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return errInteger
+			}
+			count = n
+			i++
+		case opt == "BLOCK" && i+1 < len(args):
+			i++
+		case opt == "NOACK":
+		case opt == "STREAMS" && i+3 == len(args):
+			key, from = args[i+1], args[i+2]
+			i += 2
+		default:
+			return errSyntax
+		}
+	}
+	if key == nil {
+		return errSyntax
+	}
+	e, ok := f.collection(string(key), "stream", nil)
+	if !ok {
+		return errWrongType
+	}
+	var g *fakeGroup
+	if e != nil {
+		g = e.stream.groups[group]
+	}
+	if g == nil {
+		return redis.Error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, group))
+	}
+	s := e.stream
+
+	entries := []interface{}{}
+	if string(from) == ">" {
+		for _, entry := range s.entries {
+			if count >= 0 && len(entries) == count {
+				break
+			}
+			if g.delivered.less(entry.id) {
+				g.pending[entry.id] = &fakePending{consumer: consumer, delivered: time.Now(), count: 1}
+				g.delivered = entry.id
+				entries = append(entries, entry.reply())
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+	} else {
+		start, ok := parseStreamID(from, false)
+		if !ok {
+			return errStreamID
+		}
+		for _, id := range g.pendingIDs() {
+			if count >= 0 && len(entries) == count {
+				break
+			}
+			p := g.pending[id]
+			if p.consumer != consumer || !start.less(id) {
+				continue
+			}
+			if entry, ok := s.entry(id); ok {
+				entries = append(entries, entry.reply())
+			} else {
+				entries = append(entries, []interface{}{[]byte(id.String()), nil})
+			}
+		}
+	}
+	return []interface{}{[]interface{}{append([]byte{}, key...), entries}}
+}
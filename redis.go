@@ -3,6 +3,7 @@ package rcache
 import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -14,23 +15,79 @@ var (
 type MarshalFunc func(interface{}) ([]byte, error)
 type UnmarshalFunc func([]byte, interface{}) error
 
+// Pool hands out connections to Redis. It is implemented by *redis.Pool and
+// by the go-redis adapter in the goredis package.
+type Pool interface {
+	Get() redis.Conn
+}
+
 type Cache struct {
-	Redis     *redis.Pool
+	Redis     Pool
 	Marshal   MarshalFunc
 	Unmarshal UnmarshalFunc
+	// ErrorHandler receives errors of background work such as refreshing
+	// registered keys. Errors are dropped if it is nil.
+	ErrorHandler func(error)
+	// StoreMetadata prefixes stored values with a small header recording
+	// when they were stored, see GetItem.
+	StoreMetadata bool
+	// Local is an optional in-process tier in front of Redis, see NewLRU and
+	// NewTinyLFU. Its entries are kept for at most LocalTTL, 1 minute by
+	// default.
+	Local    LocalCache
+	LocalTTL time.Duration
+	// Disk is an optional tier consulted between Local and Redis, see
+	// NewDiskCache. Its entries are kept for at most DiskTTL, 10 minutes by
+	// default.
+	Disk    LocalCache
+	DiskTTL time.Duration
+	// ChunkSize splits values larger than it into several keys, 0 disables
+	// chunking. Chunked values are read back regardless of ChunkSize.
+	ChunkSize int
+
+	// DataSource makes the cache own writes to a backing store, see WriteMode.
+	// Misses are loaded from it and cached for LoadExpiration.
+	DataSource     DataSource
+	WriteMode      WriteMode
+	WriteBehind    WriteBehindOptions
+	LoadExpiration time.Duration
+	// LeaseTimeout bounds how long a lease handed out on a miss stays valid,
+	// 10 seconds by default.
+	LeaseTimeout time.Duration
+	// InvalidationSet is the sorted set of pending deletes scheduled by
+	// InvalidateAfterWrite, "rcache:invalidations" by default.
+	InvalidationSet string
+	// MigrateFrom is the deployment being migrated away from, see Migrator.
+	// Misses of Get are looked up in it and copied to Redis with their
+	// remaining TTL, and writes and deletes are applied to both.
+	MigrateFrom Pool
 
-	conn   redis.Conn
 	hits   uint64
 	misses uint64
+
+	mu            sync.Mutex
+	refreshers    map[string]*refresher
+	version       *serverVersion
+	writer        *writeBehind
+	invalidator   *invalidator
+	invalidations map[*time.Timer]struct{}
+	subscriptions map[*Subscription]struct{}
 }
 
 type Item struct {
-	Key        string
-	Object     interface{}
+	Key    string
+	Object interface{}
+	// Value is stored as is instead of marshalling Object if it is not nil.
+	Value      []byte
 	Expiration time.Duration
+
+	// TTL, StoredAt and Size are populated by GetItem.
+	TTL      time.Duration
+	StoredAt time.Time
+	Size     int
 }
 
-func NewRedisCache(redis *redis.Pool, marshalFunc MarshalFunc, unmarshalFunc UnmarshalFunc) *Cache {
+func NewRedisCache(redis Pool, marshalFunc MarshalFunc, unmarshalFunc UnmarshalFunc) *Cache {
 	return &Cache{
 		Redis:     redis,
 		Marshal:   marshalFunc,
@@ -39,63 +96,406 @@ func NewRedisCache(redis *redis.Pool, marshalFunc MarshalFunc, unmarshalFunc Unm
 }
 
 func (c *Cache) getConn() (redis.Conn, error) {
-	if c.conn == nil {
-		conn := c.Redis.Get()
-		if err := conn.Err(); err != nil {
-			return conn, errors.WithStack(err)
-		}
+	conn := c.Redis.Get()
+	if err := conn.Err(); err != nil {
+		return conn, errors.WithStack(err)
 	}
-	return c.conn, nil
+	return conn, nil
+}
+
+func (c *Cache) handleError(err error) {
+	if c.ErrorHandler != nil {
+		c.ErrorHandler(err)
+	}
+}
+
+func expiration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return 2 * time.Minute
+	}
+	return d
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(expiration(d) / time.Millisecond)
 }
 
 func (c *Cache) Set(item *Item) error {
+	if c.DataSource != nil {
+		return c.write(item)
+	}
+	return c.set(item)
+}
+
+func (c *Cache) set(item *Item) error {
+	b, err := c.marshal(item)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	if err := c.setValue(conn, item.Key, b, item.Expiration); err != nil {
+		return err
+	}
+	return c.mirrorSet(item.Key, b, item.Expiration)
+}
+
+func (c *Cache) setValue(conn redis.Conn, key string, b []byte, expire time.Duration) error {
+	v := c.encode(b)
+	stored, err := c.writeChunks(conn, key, v, expire)
+	if err != nil {
+		return err
+	}
+	if err := c.sendSet(conn, key, stored, expire); err != nil {
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	if err := c.setReply(conn, key, replies[0]); err != nil {
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	c.setLocal(key, v, expire)
+	return nil
+}
+
+func (c *Cache) marshal(item *Item) ([]byte, error) {
+	if item.Value != nil {
+		return item.Value, nil
+	}
 	b, err := c.Marshal(item.Object)
 	if err != nil {
-		return errors.Wrap(err, "marshal failed")
+		return nil, errors.Wrap(err, "marshal failed")
 	}
+	return b, nil
+}
 
+// unmarshal leaves object untouched for empty values, use GetBytes to tell
+// empty values from misses.
+func (c *Cache) unmarshal(b []byte, object interface{}) error {
+	if raw, ok := object.(rawValue); ok {
+		*raw.b = append([]byte{}, b...)
+		return nil
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if err := c.Unmarshal(b, object); err != nil {
+		return errors.Wrap(err, "unmarshal failed")
+	}
+	return nil
+}
+
+// SetMulti stores items with a single round trip. With a DataSource, the
+// items are written like Set does.
+func (c *Cache) SetMulti(items ...*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	values, err := c.marshalMulti(items)
+	if err != nil {
+		return err
+	}
+	if c.DataSource != nil {
+		return c.writeMulti(items, values)
+	}
+	return c.setMulti(items, values)
+}
+
+func (c *Cache) marshalMulti(items []*Item) ([][]byte, error) {
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		b, err := c.marshal(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "item %q", item.Key)
+		}
+		values[i] = b
+	}
+	return values, nil
+}
+
+// setMulti stores the marshalled values of items in the cache only.
+func (c *Cache) setMulti(items []*Item, values [][]byte) error {
 	conn, err := c.getConn()
 	if err != nil {
 		return errors.Wrap(err, "getConn failed")
 	}
 	defer conn.Close()
 
-	expire := item.Expiration
-	if item.Expiration < time.Second {
-		expire = 2 * time.Minute
+	encoded := make([][]byte, len(items))
+	stored := make([][]byte, len(items))
+	for i, item := range items {
+		encoded[i] = c.encode(values[i])
+		if stored[i], err = c.writeChunks(conn, item.Key, encoded[i], item.Expiration); err != nil {
+			return err
+		}
+	}
+	for i, item := range items {
+		if err := c.sendSet(conn, item.Key, stored[i], item.Expiration); err != nil {
+			return errors.Wrap(err, "Redis SET failed")
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return errors.Wrap(err, "Redis SET failed")
 	}
-	args := []interface{}{
-		item.Key,
-		int(expire.Seconds()),
-		b,
+	for i, reply := range replies {
+		if err := c.setReply(conn, items[i].Key, reply); err != nil {
+			return errors.Wrap(err, "Redis SET failed")
+		}
+		c.setLocal(items[i].Key, encoded[i], items[i].Expiration)
 	}
-	if _, err := conn.Do("SETEX", args...); err != nil {
-		return errors.Wrap(err, "Redis SETEX failed")
+	for i, item := range items {
+		if err := c.mirrorSet(item.Key, values[i], item.Expiration); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (c *Cache) Get(key string, object interface{}) error {
+type GetOption func(*getOptions)
+
+type getOptions struct {
+	sliding time.Duration
+}
+
+// Sliding resets the expiration of the key to ttl on every hit, so that
+// entries stay cached while they are in use.
+func Sliding(ttl time.Duration) GetOption {
+	return func(o *getOptions) {
+		o.sliding = expiration(ttl)
+	}
+}
+
+func (c *Cache) Get(key string, object interface{}, opts ...GetOption) error {
+	var o getOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Sliding expiration has to reach Redis on every hit.
+	if o.sliding == 0 {
+		if v, ok := c.getLocal(key); ok {
+			atomic.AddUint64(&c.hits, 1)
+			b, _ := decode(v)
+			return c.unmarshal(b, object)
+		}
+	}
+
 	conn, err := c.getConn()
 	if err != nil {
 		return errors.Wrap(err, "getConn failed")
 	}
 	defer conn.Close()
 
-	b, err := redis.Bytes(conn.Do("GET", key))
+	b, ttl, err := c.getValue(conn, key, &o)
+	if err == redis.ErrNil && c.MigrateFrom != nil {
+		b, ttl, err = c.migrateKey(conn, key)
+		if err != nil && err != redis.ErrNil {
+			// An outage of the old deployment only costs its values.
+			c.handleError(errors.Wrapf(err, "migration of %q failed", key))
+			err = redis.ErrNil
+		}
+	}
 	if err != nil {
 		if err == redis.ErrNil {
 			atomic.AddUint64(&c.misses, 1)
+			if c.DataSource != nil {
+				return c.load(conn, key, object)
+			}
 			return ErrCacheMiss
 		}
 		return errors.Wrap(err, "Redis GET failed")
 	}
 	atomic.AddUint64(&c.hits, 1)
-	if len(b) == 0 {
-		return nil
+	if o.sliding == 0 {
+		c.cacheLocal(key, b, ttl)
 	}
-	if err := c.Unmarshal(b, object); err != nil {
-		return errors.Wrap(err, "unmarshal failed")
+	b, _ = decode(b)
+	return c.unmarshal(b, object)
+}
+
+// getValue returns the value of key and its remaining TTL.
+func (c *Cache) getValue(conn redis.Conn, key string, o *getOptions) ([]byte, time.Duration, error) {
+	if o.sliding == 0 {
+		v, ttl, err := c.getWithTTL(conn, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		b, _, err := c.resolve(conn, key, v)
+		return b, ttl, err
+	}
+
+	v, err := c.getAndExpire(conn, key, o.sliding)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, m, err := c.resolve(conn, key, v)
+	if err != nil {
+		return nil, 0, err
+	}
+	if m != nil {
+		if err := c.expireChunks(conn, key, m, o.sliding); err != nil {
+			return nil, 0, err
+		}
+	}
+	return b, o.sliding, nil
+}
+
+// getWithTTL reads key and, if there are local tiers to fill, its remaining
+// TTL.
+func (c *Cache) getWithTTL(conn redis.Conn, key string) ([]byte, time.Duration, error) {
+	if c.Local == nil && c.Disk == nil {
+		v, err := redis.Bytes(conn.Do("GET", key))
+		return v, noExpiry, err
+	}
+	if err := conn.Send("GET", key); err != nil {
+		return nil, 0, err
+	}
+	if err := conn.Send("PTTL", key); err != nil {
+		return nil, 0, err
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := redis.Bytes(replies[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	pttl, err := redis.Int64(replies[1], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case pttl == -1:
+		return v, noExpiry, nil
+	case pttl < 0:
+		// The key expired since it was read.
+		return v, 0, nil
+	}
+	return v, time.Duration(pttl) * time.Millisecond, nil
+}
+
+func (c *Cache) getAndExpire(conn redis.Conn, key string, ttl time.Duration) ([]byte, error) {
+	// GETEX is available since Redis 6.2.
+	getex, err := c.supports(conn, 6, 2)
+	if err != nil {
+		return nil, err
+	}
+	ms := int64(ttl / time.Millisecond)
+	if getex {
+		return redis.Bytes(conn.Do("GETEX", key, "PX", ms))
+	}
+	if err := conn.Send("GET", key); err != nil {
+		return nil, err
+	}
+	if err := conn.Send("PEXPIRE", key, ms); err != nil {
+		return nil, err
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	return redis.Bytes(replies[0], nil)
+}
+
+// SetBytes stores b under key without marshalling it.
+func (c *Cache) SetBytes(key string, b []byte, expiration time.Duration) error {
+	if b == nil {
+		b = []byte{}
+	}
+	return c.Set(&Item{Key: key, Value: b, Expiration: expiration})
+}
+
+// GetBytes returns the raw value of key without unmarshalling it. A cached
+// empty value is returned as an empty, non-nil slice, a missing key as
+// ErrCacheMiss.
+func (c *Cache) GetBytes(key string, opts ...GetOption) ([]byte, error) {
+	var b []byte
+	if err := c.Get(key, rawValue{&b}, opts...); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// rawValue makes Get store the raw value instead of unmarshalling it.
+type rawValue struct {
+	b *[]byte
+}
+
+func (c *Cache) Delete(key string) error {
+	// The old deployment goes first, so that a concurrent miss cannot copy
+	// the value back.
+	if err := c.mirrorDelete(key); err != nil {
+		return err
+	}
+	if c.DataSource != nil {
+		return c.remove(key)
+	}
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	return c.delValue(conn, key)
+}
+
+func (c *Cache) delValue(conn redis.Conn, key string) error {
+	if err := c.sendDel(conn, key); err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	if err := c.delReply(conn, key, replies[0]); err != nil {
+		return errors.Wrap(err, "Redis DEL failed")
+	}
+	return nil
+}
+
+// Close stops all background work started by the cache.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	refreshers := c.refreshers
+	c.refreshers = nil
+	writer := c.writer
+	c.writer = nil
+	inv := c.invalidator
+	c.invalidator = nil
+	invalidations := c.invalidations
+	c.invalidations = nil
+	subscriptions := c.subscriptions
+	c.subscriptions = nil
+	c.mu.Unlock()
+	for s := range subscriptions {
+		s.close()
+	}
+	for _, r := range refreshers {
+		close(r.stop)
+	}
+	if writer != nil {
+		close(writer.stop)
+		<-writer.done
+	}
+	if inv != nil {
+		close(inv.stop)
+		<-inv.done
+	}
+	// The pending second deletes are left to StartInvalidator.
+	for timer := range invalidations {
+		timer.Stop()
+	}
+	for _, r := range refreshers {
+		<-r.done
 	}
 	return nil
 }
@@ -0,0 +1,135 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	ErrAlreadyRegistered = errors.New("cache: key is already registered")
+	ErrIntervalTooShort  = errors.New("cache: refresh interval is shorter than a second")
+)
+
+type Loader func() (interface{}, error)
+
+type refresher struct {
+	key      string
+	loader   Loader
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Register keeps key refreshed in the background by calling loader every
+// interval until Unregister or Close is called. The value is stored for two
+// intervals, so it survives a missed refresh. Across processes only one
+// instance refreshes per interval. When loader fails, the last good value is
+// kept and the refresh is retried with exponential backoff. Intervals shorter
+// than a second are rejected with ErrIntervalTooShort.
+func (c *Cache) Register(key string, loader Loader, interval time.Duration) error {
+	if interval < time.Second {
+		return ErrIntervalTooShort
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshers == nil {
+		c.refreshers = make(map[string]*refresher)
+	}
+	if _, ok := c.refreshers[key]; ok {
+		return ErrAlreadyRegistered
+	}
+	r := &refresher{
+		key:      key,
+		loader:   loader,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	c.refreshers[key] = r
+	go c.refresh(r)
+	return nil
+}
+
+func (c *Cache) Unregister(key string) {
+	c.mu.Lock()
+	r, ok := c.refreshers[key]
+	delete(c.refreshers, key)
+	c.mu.Unlock()
+	if ok {
+		close(r.stop)
+		<-r.done
+	}
+}
+
+func (c *Cache) refresh(r *refresher) {
+	defer close(r.done)
+	var wait, backoff time.Duration
+	for {
+		if !sleep(wait, r.stop) {
+			return
+		}
+
+		if err := c.refreshKey(r); err != nil {
+			c.handleError(errors.Wrapf(err, "refresh of %q failed", r.key))
+			backoff = nextBackoff(backoff, r.interval)
+			wait = backoff
+			continue
+		}
+		backoff = 0
+		wait = r.interval
+	}
+}
+
+func (c *Cache) refreshKey(r *refresher) error {
+	lockKey := reservedKey(r.key, "refresh-lock")
+	// The lock is left to expire after a successful refresh, so that other
+	// instances skip the rest of the interval.
+	token, ok, err := c.lock(lockKey, r.interval)
+	if err != nil || !ok {
+		return err
+	}
+
+	object, err := r.loader()
+	if err != nil {
+		if err := c.unlock(lockKey, token); err != nil {
+			c.handleError(err)
+		}
+		if err := c.expire(r.key, 2*r.interval); err != nil {
+			c.handleError(err)
+		}
+		return errors.Wrap(err, "loader failed")
+	}
+	if err := c.set(&Item{Key: r.key, Object: object, Expiration: 2 * r.interval}); err != nil {
+		if err := c.unlock(lockKey, token); err != nil {
+			c.handleError(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// expire extends the TTL of key and, if it is chunked, of its chunks.
+func (c *Cache) expire(key string, ttl time.Duration) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	v, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Redis GET failed")
+	}
+	if _, err := conn.Do("PEXPIRE", key, int64(ttl/time.Millisecond)); err != nil {
+		return errors.Wrap(err, "Redis PEXPIRE failed")
+	}
+	if m, ok := parseManifest(v); ok {
+		return c.expireChunks(conn, key, m, ttl)
+	}
+	return nil
+}
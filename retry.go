@@ -0,0 +1,28 @@
+package rcache
+
+import "time"
+
+// nextBackoff returns how long to wait after another failure, given the
+// previous wait: twice as long, but at least a second and at most max.
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < time.Second {
+		backoff = time.Second
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// sleep waits for d and reports whether it did so before stop was closed.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,68 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const scanCount = 1000
+
+// Scan calls fn with each key matching pattern, which uses the glob-style
+// syntax of Redis. Keys modified during the scan may be reported twice or
+// not at all, and the internal keys of chunked values and leases are
+// included. Scanning stops at the first error returned by fn.
+func (c *Cache) Scan(pattern string, fn func(key string) error) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	return scan(conn, pattern, func(keys []string) error {
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// internal reports whether key is one the cache keeps for itself: the keys
+// named by reservedKey, the write-behind stream and the pending invalidations.
+func (c *Cache) internal(key string) bool {
+	if reservedKeyPattern.MatchString(key) {
+		return true
+	}
+	opts := c.WriteBehind.withDefaults()
+	return key == opts.Stream || key == latestKey(opts) || key == c.invalidationSet()
+}
+
+// scan calls fn with each page of keys returned by SCAN.
+func scan(conn redis.Conn, pattern string, fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return errors.Wrap(err, "Redis SCAN failed")
+		}
+		if len(reply) != 2 {
+			return errors.New("Redis SCAN failed: unexpected reply")
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return errors.Wrap(err, "Redis SCAN failed")
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return errors.Wrap(err, "Redis SCAN failed")
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package rcache
+
+import (
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ShadowOptions struct {
+	// SampleRate is the fraction of keys whose operations are mirrored,
+	// 0.01 by default. Keys are sampled by hash, so that the secondary sees
+	// every write of the keys whose reads are compared.
+	SampleRate float64
+	// Workers is the number of goroutines applying mirrored operations, 4 by
+	// default. Operations on a key are applied in order by the same worker.
+	Workers int
+	// QueueSize bounds the operations waiting for each worker, 1000 by
+	// default. Operations beyond it are dropped, see Shadow.Dropped.
+	QueueSize int
+	// Report receives the outcome of each mirrored operation. It is called
+	// from the workers and must be safe for concurrent use.
+	Report func(ShadowReport)
+}
+
+func (o ShadowOptions) withDefaults() ShadowOptions {
+	if o.SampleRate <= 0 {
+		o.SampleRate = 0.01
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1000
+	}
+	return o
+}
+
+type ShadowReport struct {
+	// Op is "get", "set" or "delete".
+	Op  string
+	Key string
+	// Diverged reports that the secondary returned another value than the
+	// primary, or missed when the primary hit or the reverse. Keys written
+	// before shadowing started are missing from a fresh secondary.
+	Diverged      bool
+	PrimaryMiss   bool
+	SecondaryMiss bool
+	// Err is the error returned by the secondary.
+	Err error
+
+	PrimaryLatency   time.Duration
+	SecondaryLatency time.Duration
+	// PrimarySize and SecondarySize are the marshalled sizes of the value
+	// read or written.
+	PrimarySize   int
+	SecondarySize int
+}
+
+// Shadow serves reads and writes from a primary cache and mirrors a sample
+// of them to a secondary one in the background, to compare another
+// configuration against real traffic. Callers only ever see the results of
+// the primary, the secondary merely adds the cost of marshalling sampled
+// values once more.
+type Shadow struct {
+	Primary   *Cache
+	Secondary *Cache
+
+	opts      ShadowOptions
+	threshold uint32
+	queues    []chan func()
+	dropped   uint64
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewShadow(primary, secondary *Cache, opts ShadowOptions) *Shadow {
+	opts = opts.withDefaults()
+	s := &Shadow{
+		Primary:   primary,
+		Secondary: secondary,
+		opts:      opts,
+		threshold: math.MaxUint32,
+		queues:    make([]chan func(), opts.Workers),
+	}
+	if opts.SampleRate < 1 {
+		s.threshold = uint32(opts.SampleRate * math.MaxUint32)
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan func(), opts.QueueSize)
+		s.wg.Add(1)
+		go s.work(s.queues[i])
+	}
+	return s
+}
+
+func (s *Shadow) work(queue chan func()) {
+	defer s.wg.Done()
+	for fn := range queue {
+		fn()
+	}
+}
+
+func (s *Shadow) Get(key string, object interface{}, opts ...GetOption) error {
+	h, sampled := s.sample(key)
+	if !sampled || object == nil || reflect.TypeOf(object).Kind() != reflect.Ptr {
+		return s.Primary.Get(key, object, opts...)
+	}
+
+	start := time.Now()
+	err := s.Primary.Get(key, object, opts...)
+	r := ShadowReport{Op: "get", Key: key, PrimaryLatency: time.Since(start)}
+	var snapshot []byte
+	switch err {
+	case nil:
+		// The object belongs to the caller once Get returns, so the value is
+		// compared in its marshalled form.
+		b, merr := s.Primary.Marshal(object)
+		if merr != nil {
+			return nil
+		}
+		snapshot = b
+		r.PrimarySize = len(b)
+	case ErrCacheMiss:
+		r.PrimaryMiss = true
+	default:
+		return err
+	}
+
+	s.enqueue(h, func() {
+		got := newObject(object)
+		start := time.Now()
+		r.Err = s.Secondary.Get(key, got, opts...)
+		r.SecondaryLatency = time.Since(start)
+		switch {
+		case r.Err == ErrCacheMiss:
+			r.Err = nil
+			r.SecondaryMiss = true
+			r.Diverged = !r.PrimaryMiss
+		case r.Err != nil:
+		case r.PrimaryMiss:
+			r.Diverged = true
+		default:
+			if b, err := s.Secondary.Marshal(got); err == nil {
+				r.SecondarySize = len(b)
+			}
+			want := newObject(object)
+			if err := s.Primary.Unmarshal(snapshot, want); err != nil {
+				r.Err = err
+				break
+			}
+			r.Diverged = !reflect.DeepEqual(want, got)
+		}
+		s.report(r)
+	})
+	return err
+}
+
+func (s *Shadow) Set(item *Item) error {
+	h, sampled := s.sample(item.Key)
+	if !sampled {
+		return s.Primary.Set(item)
+	}
+
+	start := time.Now()
+	if err := s.Primary.Set(item); err != nil {
+		return err
+	}
+	r := ShadowReport{Op: "set", Key: item.Key, PrimaryLatency: time.Since(start)}
+	snapshot, err := s.Primary.marshal(item)
+	if err != nil {
+		return nil
+	}
+	// Objects are mirrored as such, so that the secondary marshals them.
+	var object interface{}
+	if item.Value != nil {
+		snapshot = append([]byte{}, snapshot...)
+	} else if item.Object != nil {
+		object = newObject(item.Object)
+	}
+	r.PrimarySize = len(snapshot)
+	key, expiration := item.Key, item.Expiration
+
+	s.enqueue(h, func() {
+		mirrored := &Item{Key: key, Value: snapshot, Expiration: expiration}
+		r.SecondarySize = len(snapshot)
+		if object != nil {
+			if err := s.Primary.Unmarshal(snapshot, object); err != nil {
+				r.Err = err
+				s.report(r)
+				return
+			}
+			mirrored.Value, mirrored.Object = nil, object
+			if b, err := s.Secondary.Marshal(object); err == nil {
+				r.SecondarySize = len(b)
+			}
+		}
+		start := time.Now()
+		r.Err = s.Secondary.Set(mirrored)
+		r.SecondaryLatency = time.Since(start)
+		s.report(r)
+	})
+	return nil
+}
+
+func (s *Shadow) Delete(key string) error {
+	h, sampled := s.sample(key)
+	if !sampled {
+		return s.Primary.Delete(key)
+	}
+
+	start := time.Now()
+	if err := s.Primary.Delete(key); err != nil {
+		return err
+	}
+	r := ShadowReport{Op: "delete", Key: key, PrimaryLatency: time.Since(start)}
+	s.enqueue(h, func() {
+		start := time.Now()
+		r.Err = s.Secondary.Delete(key)
+		r.SecondaryLatency = time.Since(start)
+		s.report(r)
+	})
+	return nil
+}
+
+// Dropped returns the number of sampled operations that were not mirrored
+// because the queue of their worker was full.
+func (s *Shadow) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close waits for the queued operations to be mirrored and stops the
+// workers. The caches are left open.
+func (s *Shadow) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, queue := range s.queues {
+			close(queue)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Shadow) sample(key string) (uint32, bool) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	sum := h.Sum32()
+	return sum, sum <= s.threshold
+}
+
+func (s *Shadow) enqueue(h uint32, fn func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queues[h%uint32(len(s.queues))] <- fn:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *Shadow) report(r ShadowReport) {
+	if s.opts.Report != nil {
+		s.opts.Report(r)
+	}
+}
+
+// newObject returns a pointer to a new zero value of the type object points
+// to, or of its type if it is not a pointer.
+func newObject(object interface{}) interface{} {
+	t := reflect.TypeOf(object)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface()
+}
@@ -0,0 +1,157 @@
+package rcache
+
+import (
+	"bytes"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStreamChunkSize is used by SetStream if ChunkSize is not set.
+const defaultStreamChunkSize = 512 * 1024
+
+// SetStream stores the contents of r under key without marshalling it. The
+// data is written in chunks of ChunkSize bytes, so memory use does not depend
+// on the size of the blob. The blob becomes visible once r is exhausted.
+func (c *Cache) SetStream(key string, r io.Reader, expire time.Duration) error {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultStreamChunkSize
+	}
+	id, err := newToken()
+	if err != nil {
+		return errors.Wrap(err, "newToken failed")
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	m := &manifest{ID: id}
+	ttl := milliseconds(expire) + int64(chunkGrace/time.Millisecond)
+	buf := make([]byte, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := conn.Do("SET", m.chunkKey(key, m.Chunks), buf[:n], "PX", ttl); err != nil {
+				c.deleteChunks(conn, key, m)
+				return errors.Wrap(err, "Redis SET failed")
+			}
+			m.Chunks++
+			m.Size += n
+			m.CRC32 = crc32.Update(m.CRC32, crc32.IEEETable, buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			c.deleteChunks(conn, key, m)
+			return errors.Wrap(err, "read failed")
+		}
+	}
+
+	reply, err := setScript.Do(conn, key, m.encode(), milliseconds(expire), manifestMagic)
+	if err != nil {
+		c.deleteChunks(conn, key, m)
+		return errors.Wrap(err, "Redis SET failed")
+	}
+	// The local tiers would keep serving the replaced value.
+	c.deleteLocal(key)
+	// The TTL of the chunks was counted from before r was exhausted, so they
+	// are extended to outlive the manifest again.
+	if err := c.expireChunks(conn, key, m, expiration(expire)); err != nil {
+		return err
+	}
+	if reply != nil {
+		if err := c.deleteReplaced(conn, key, reply); err != nil {
+			return errors.Wrap(err, "Redis DEL failed")
+		}
+	}
+	return c.mirrorStream(conn, key, m, expire)
+}
+
+// GetStream returns a reader of the blob stored under key. Chunks are fetched
+// as the reader is consumed. Values stored with Set are returned as stored.
+func (c *Cache) GetStream(key string) (io.ReadCloser, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	v, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil {
+		if err == redis.ErrNil {
+			atomic.AddUint64(&c.misses, 1)
+			return nil, ErrCacheMiss
+		}
+		return nil, errors.Wrap(err, "Redis GET failed")
+	}
+	atomic.AddUint64(&c.hits, 1)
+	m, ok := parseManifest(v)
+	if !ok {
+		b, _ := decode(v)
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return &chunkReader{c: c, key: key, m: m}, nil
+}
+
+type chunkReader struct {
+	c    *Cache
+	key  string
+	m    *manifest
+	next int
+	buf  []byte
+	crc  uint32
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next == r.m.Chunks {
+			if r.size != r.m.Size || r.crc != r.m.CRC32 {
+				return 0, ErrChecksumMismatch
+			}
+			return 0, io.EOF
+		}
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) fetch() error {
+	conn, err := r.c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	chunk, err := redis.Bytes(conn.Do("GET", r.m.chunkKey(r.key, r.next)))
+	if err == redis.ErrNil {
+		// The blob expired or was replaced while reading it.
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return errors.Wrap(err, "Redis GET failed")
+	}
+	r.next++
+	r.size += len(chunk)
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, chunk)
+	r.buf = chunk
+	return nil
+}
+
+func (r *chunkReader) Close() error {
+	r.buf = nil
+	return nil
+}
@@ -0,0 +1,69 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync/atomic"
+)
+
+var getDelScript = redis.NewScript(1, `
+-- rcache:getdel
+local v = redis.call("GET", KEYS[1])
+if v then
+	redis.call("DEL", KEYS[1])
+end
+return v
+`)
+
+// Take atomically reads and deletes key, so that only one caller gets the
+// value. It returns ErrCacheMiss if the key was already taken.
+func (c *Cache) Take(key string, object interface{}) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	// GETDEL is available since Redis 6.2.
+	getdel, err := c.supports(conn, 6, 2)
+	if err != nil {
+		return err
+	}
+	if c.MigrateFrom != nil {
+		// A value not migrated yet is copied, so that it is taken below, and
+		// the old deployment is emptied, so that a miss cannot copy it back.
+		if _, _, err := c.migrateKey(conn, key); err != nil && err != redis.ErrNil {
+			return errors.Wrap(err, "Redis GET failed")
+		}
+		if err := c.mirrorDelete(key); err != nil {
+			return err
+		}
+	}
+	c.deleteLocal(key)
+	var v []byte
+	if getdel {
+		v, err = redis.Bytes(conn.Do("GETDEL", key))
+	} else {
+		v, err = redis.Bytes(getDelScript.Do(conn, key))
+	}
+	var b []byte
+	if err == nil {
+		var m *manifest
+		b, m, err = c.resolve(conn, key, v)
+		if m != nil {
+			if err := c.deleteChunks(conn, key, m); err != nil {
+				return err
+			}
+		}
+	}
+	if err != nil {
+		if err == redis.ErrNil {
+			atomic.AddUint64(&c.misses, 1)
+			return ErrCacheMiss
+		}
+		return errors.Wrap(err, "Redis GETDEL failed")
+	}
+	atomic.AddUint64(&c.hits, 1)
+	b, _ = decode(b)
+	return c.unmarshal(b, object)
+}
@@ -0,0 +1,212 @@
+package rcache
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// TinyLFU is a LocalCache implementing the W-TinyLFU policy. New entries
+// enter a small LRU window. Entries leaving the window are only admitted to
+// the main segmented LRU if they were accessed more frequently than the entry
+// they would evict, which keeps one-off scans from flushing the cache.
+// Frequencies are estimated with a count-min sketch that is halved
+// periodically so that old popularity fades.
+type TinyLFU struct {
+	// Cost defaults to the size of key and value plus a fixed overhead.
+	Cost CostFunc
+
+	mu        sync.Mutex
+	entries   map[string]*localEntry
+	window    segment
+	probation segment
+	protected segment
+	mainCost  int64
+	sketch    *sketch
+}
+
+// NewTinyLFU returns a TinyLFU bounded by maxCost. expectedEntries sizes the
+// frequency sketch and should be about the number of entries that fit.
+func NewTinyLFU(maxCost int64, expectedEntries int) *TinyLFU {
+	windowCost := maxCost / 100
+	if windowCost < 1 {
+		windowCost = 1
+	}
+	mainCost := maxCost - windowCost
+	return &TinyLFU{
+		entries:   make(map[string]*localEntry),
+		window:    segment{maxCost: windowCost},
+		probation: segment{maxCost: mainCost - mainCost*80/100},
+		protected: segment{maxCost: mainCost * 80 / 100},
+		mainCost:  mainCost,
+		sketch:    newSketch(expectedEntries),
+	}
+}
+
+func (t *TinyLFU) Get(key string) ([]byte, bool) {
+	h := hashKey(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sketch.increment(h)
+	e, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		t.remove(e)
+		return nil, false
+	}
+	switch e.segment {
+	case &t.probation:
+		t.probation.remove(e)
+		t.protected.pushFront(e)
+		for t.protected.overflows() {
+			demoted := t.protected.back()
+			t.protected.remove(demoted)
+			t.probation.pushFront(demoted)
+		}
+	default:
+		e.segment.list.MoveToFront(e.elem)
+	}
+	return e.value, true
+}
+
+func (t *TinyLFU) Set(key string, value []byte, ttl time.Duration) {
+	e := newLocalEntry(t.Cost, key, value, ttl)
+	h := hashKey(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sketch.increment(h)
+	if old, ok := t.entries[key]; ok {
+		t.remove(old)
+	}
+	if e.cost > t.mainCost {
+		return
+	}
+	t.entries[key] = e
+	t.window.pushFront(e)
+	for t.window.overflows() {
+		candidate := t.window.back()
+		t.window.remove(candidate)
+		t.admit(candidate)
+	}
+}
+
+func (t *TinyLFU) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[key]; ok {
+		t.remove(e)
+	}
+}
+
+func (t *TinyLFU) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+// Purge removes all entries. The frequency sketch is kept.
+func (t *TinyLFU) Purge() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = make(map[string]*localEntry)
+	for _, s := range []*segment{&t.window, &t.probation, &t.protected} {
+		s.list.Init()
+		s.cost = 0
+	}
+}
+
+// admit moves candidate from the window to the main segments if it is more
+// popular than each of the entries it has to evict, and drops it otherwise.
+// Victims are only evicted once the candidate is known to be admitted.
+func (t *TinyLFU) admit(candidate *localEntry) {
+	freq := t.sketch.estimate(hashKey(candidate.key))
+	excess := t.probation.cost + t.protected.cost + candidate.cost - t.mainCost
+	var victims []*localEntry
+	for _, s := range []*segment{&t.probation, &t.protected} {
+		for elem := s.list.Back(); elem != nil && excess > 0; elem = elem.Prev() {
+			victim := elem.Value.(*localEntry)
+			if freq <= t.sketch.estimate(hashKey(victim.key)) {
+				delete(t.entries, candidate.key)
+				return
+			}
+			victims = append(victims, victim)
+			excess -= victim.cost
+		}
+	}
+	for _, victim := range victims {
+		t.remove(victim)
+	}
+	t.probation.pushFront(candidate)
+}
+
+func (t *TinyLFU) remove(e *localEntry) {
+	e.segment.remove(e)
+	delete(t.entries, e.key)
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// sketch is a count-min sketch of 4-bit saturating counters, stored one per
+// byte for simplicity.
+type sketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+func newSketch(expectedEntries int) *sketch {
+	width := 64
+	for width < expectedEntries {
+		width *= 2
+	}
+	s := &sketch{mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) index(h uint64, i int) uint64 {
+	h = (h ^ sketchSeeds[i]) * 0x9e3779b97f4a7c15
+	return (h ^ h>>32) & s.mask
+}
+
+func (s *sketch) increment(h uint64) {
+	for i := range s.rows {
+		if j := s.index(h, i); s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(h uint64) uint8 {
+	min := uint8(15)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,183 @@
+package rcache
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func unitCost(key string, value []byte) int64 {
+	return 1
+}
+
+func TestTinyLFUMaxCost(t *testing.T) {
+	c := NewTinyLFU(10000, 100)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c.Set(strconv.Itoa(r.Intn(500)), make([]byte, r.Intn(200)), 0)
+	}
+	cost := c.window.cost + c.probation.cost + c.protected.cost
+	if cost > 10000 {
+		t.Errorf("cost = %d, want at most 10000", cost)
+	}
+	if n := c.window.list.Len() + c.probation.list.Len() + c.protected.list.Len(); n != c.Len() {
+		t.Errorf("segments hold %d entries, Len() = %d", n, c.Len())
+	}
+}
+
+func TestTinyLFUScanResistance(t *testing.T) {
+	c := NewTinyLFU(1000, 1000)
+	c.Cost = unitCost
+	for i := 0; i < 100; i++ {
+		key := "hot" + strconv.Itoa(i)
+		c.Set(key, []byte{1}, 0)
+		for j := 0; j < 10; j++ {
+			c.Get(key)
+		}
+	}
+	// A scan of three times the capacity, which would flush an LRU.
+	for i := 0; i < 3000; i++ {
+		c.Set("scan"+strconv.Itoa(i), []byte{1}, 0)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := c.Get("hot" + strconv.Itoa(i)); !ok {
+			t.Errorf("hot%d was evicted by the scan", i)
+		}
+	}
+}
+
+func TestTinyLFUAdmit(t *testing.T) {
+	c := NewTinyLFU(100, 100)
+	c.Cost = func(key string, value []byte) int64 {
+		return int64(len(value))
+	}
+	add := func(key string, cost, freq int) *localEntry {
+		e := newLocalEntry(c.Cost, key, make([]byte, cost), 0)
+		for i := 0; i < freq; i++ {
+			c.sketch.increment(hashKey(key))
+		}
+		c.entries[key] = e
+		return e
+	}
+	c.probation.pushFront(add("cold", 50, 1))
+	c.probation.pushFront(add("warm", 49, 6))
+
+	// Admitting candidate would evict both entries, but warm is more
+	// popular, so nothing may be evicted.
+	c.admit(add("candidate", 60, 4))
+	for key, want := range map[string]bool{"cold": true, "warm": true, "candidate": false} {
+		if _, ok := c.entries[key]; ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	c.admit(add("popular", 60, 10))
+	for key, want := range map[string]bool{"cold": false, "warm": false, "popular": true} {
+		if _, ok := c.entries[key]; ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+	if c.probation.cost != 60 {
+		t.Errorf("probation cost = %d, want 60", c.probation.cost)
+	}
+}
+
+type trace struct {
+	name     string
+	capacity int64
+	keys     []string
+}
+
+// hitRatioTraces returns synthetic traces, and the trace recorded in the
+// file named by RCACHE_TRACE, one key per line, if set.
+func hitRatioTraces(b *testing.B) []trace {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.01, 1, 100000)
+	var traces []trace
+
+	keys := make([]string, 200000)
+	for i := range keys {
+		keys[i] = strconv.FormatUint(zipf.Uint64(), 10)
+	}
+	traces = append(traces, trace{"zipf", 1000, keys})
+
+	// Zipf traffic interrupted by scans of keys that are never read again.
+	keys = nil
+	for i := 0; i < 200000; i++ {
+		if i%20000 < 5000 {
+			keys = append(keys, "scan"+strconv.Itoa(i))
+		} else {
+			keys = append(keys, strconv.FormatUint(zipf.Uint64(), 10))
+		}
+	}
+	traces = append(traces, trace{"zipf-scan", 1000, keys})
+
+	// A loop slightly larger than the cache, the worst case of LRU.
+	keys = nil
+	for i := 0; i < 200000; i++ {
+		keys = append(keys, strconv.Itoa(i%1200))
+	}
+	traces = append(traces, trace{"loop", 1000, keys})
+
+	if name := os.Getenv("RCACHE_TRACE"); name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		keys = nil
+		unique := make(map[string]bool)
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			keys = append(keys, s.Text())
+			unique[s.Text()] = true
+		}
+		if err := s.Err(); err != nil {
+			b.Fatal(err)
+		}
+		traces = append(traces, trace{"recorded", int64(len(unique)/10 + 1), keys})
+	}
+	return traces
+}
+
+// BenchmarkHitRatio replays traces against LRU and TinyLFU caches holding
+// the same number of entries, and reports their hit ratios.
+func BenchmarkHitRatio(b *testing.B) {
+	policies := []struct {
+		name string
+		new  func(capacity int64) LocalCache
+	}{
+		{"LRU", func(capacity int64) LocalCache {
+			l := NewLRU(capacity)
+			l.Cost = unitCost
+			return l
+		}},
+		{"TinyLFU", func(capacity int64) LocalCache {
+			t := NewTinyLFU(capacity, int(capacity))
+			t.Cost = unitCost
+			return t
+		}},
+	}
+	value := []byte{1}
+	for _, tr := range hitRatioTraces(b) {
+		for _, policy := range policies {
+			b.Run(tr.name+"/"+policy.name, func(b *testing.B) {
+				var hits, total int
+				for i := 0; i < b.N; i++ {
+					c := policy.new(tr.capacity)
+					for _, key := range tr.keys {
+						if _, ok := c.Get(key); ok {
+							hits++
+						} else {
+							c.Set(key, value, 0)
+						}
+						total++
+					}
+				}
+				b.ReportMetric(float64(hits)/float64(total), "hit-ratio")
+			})
+		}
+	}
+}
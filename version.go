@@ -0,0 +1,70 @@
+package rcache
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+type serverVersion [3]int
+
+func (v serverVersion) atLeast(major, minor int) bool {
+	if v[0] != major {
+		return v[0] > major
+	}
+	return v[1] >= minor
+}
+
+func parseServerVersion(info string) (serverVersion, error) {
+	var v serverVersion
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "redis_version:") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "redis_version:"), ".", 3)
+		for i, part := range parts {
+			n, err := strconv.Atoi(strings.TrimRightFunc(part, func(r rune) bool {
+				return r < '0' || r > '9'
+			}))
+			if err != nil {
+				return v, errors.Wrapf(err, "invalid redis_version %q", line)
+			}
+			v[i] = n
+		}
+		return v, nil
+	}
+	return v, errors.New("redis_version is missing from INFO")
+}
+
+// serverVersion probes the Redis version once and caches it.
+func (c *Cache) serverVersion(conn redis.Conn) (serverVersion, error) {
+	c.mu.Lock()
+	v := c.version
+	c.mu.Unlock()
+	if v != nil {
+		return *v, nil
+	}
+
+	info, err := redis.String(conn.Do("INFO", "server"))
+	if err != nil {
+		return serverVersion{}, errors.Wrap(err, "Redis INFO failed")
+	}
+	version, err := parseServerVersion(info)
+	if err != nil {
+		return version, err
+	}
+	c.mu.Lock()
+	c.version = &version
+	c.mu.Unlock()
+	return version, nil
+}
+
+func (c *Cache) supports(conn redis.Conn, major, minor int) (bool, error) {
+	v, err := c.serverVersion(conn)
+	if err != nil {
+		return false, err
+	}
+	return v.atLeast(major, minor), nil
+}
@@ -0,0 +1,244 @@
+package rcache
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// KeyIterator yields the keys a Warmer should fill. Next returns false once
+// the keys are exhausted or iteration failed, in which case Err reports why.
+// Resuming from a checkpoint requires the iterator to yield keys in the same
+// order on every run.
+type KeyIterator interface {
+	Next() (string, bool)
+	Err() error
+}
+
+// BatchLoader loads the objects for keys. Keys missing from the returned map
+// are not cached.
+type BatchLoader func(keys []string) (map[string]interface{}, error)
+
+type WarmProgress struct {
+	Scanned uint64
+	Skipped uint64
+	Loaded  uint64
+	Failed  uint64
+	// Checkpoint is the last key up to which every batch was processed.
+	// Passing it as Warmer.Checkpoint resumes warming after that key. Failed
+	// batches are not retried then, their keys are reported to
+	// Warmer.Errors instead.
+	Checkpoint string
+}
+
+type Warmer struct {
+	Cache      *Cache
+	Keys       KeyIterator
+	Load       BatchLoader
+	Expiration time.Duration
+
+	BatchSize   int
+	Concurrency int
+	// RateLimit is the most keys loaded per second, 0 means no limit.
+	RateLimit  int
+	Checkpoint string
+
+	Progress func(WarmProgress)
+	Errors   func(keys []string, err error)
+}
+
+type warmBatch struct {
+	seq  int
+	keys []string
+}
+
+type warmResult struct {
+	seq     int
+	keys    []string
+	scanned int
+	skipped int
+	loaded  int
+	err     error
+}
+
+// Run fills the cache with keys that are not cached yet and returns once the
+// iterator is exhausted or ctx is done. Failed batches are reported to Errors
+// and counted in the progress, only an iterator failure or ctx's error is
+// returned.
+func (w *Warmer) Run(ctx context.Context) (WarmProgress, error) {
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var limiter <-chan time.Time
+	if w.RateLimit > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(batchSize) / time.Duration(w.RateLimit))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	batches := make(chan warmBatch)
+	results := make(chan warmResult)
+	go w.produce(ctx, batches, batchSize, limiter)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				results <- w.warm(b)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	progress := WarmProgress{Checkpoint: w.Checkpoint}
+	// Batches complete out of order, the checkpoint only moves past a batch
+	// once all the batches before it completed too.
+	done := make(map[int]string)
+	next := 0
+	for r := range results {
+		progress.Scanned += uint64(r.scanned)
+		progress.Skipped += uint64(r.skipped)
+		progress.Loaded += uint64(r.loaded)
+		if r.err != nil {
+			progress.Failed += uint64(r.scanned - r.skipped)
+			if w.Errors != nil {
+				w.Errors(r.keys, r.err)
+			}
+		}
+		done[r.seq] = r.keys[len(r.keys)-1]
+		for {
+			last, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			progress.Checkpoint = last
+			next++
+		}
+		if w.Progress != nil {
+			w.Progress(progress)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return progress, err
+	}
+	return progress, errors.Wrap(w.Keys.Err(), "key iterator failed")
+}
+
+func (w *Warmer) produce(ctx context.Context, batches chan<- warmBatch, batchSize int, limiter <-chan time.Time) {
+	defer close(batches)
+	skipping := w.Checkpoint != ""
+	seq := 0
+	keys := make([]string, 0, batchSize)
+	send := func() bool {
+		if limiter != nil {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-limiter:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case batches <- warmBatch{seq: seq, keys: keys}:
+		}
+		seq++
+		keys = make([]string, 0, batchSize)
+		return true
+	}
+	for ctx.Err() == nil {
+		key, ok := w.Keys.Next()
+		if !ok {
+			break
+		}
+		if skipping {
+			skipping = key != w.Checkpoint
+			continue
+		}
+		keys = append(keys, key)
+		if len(keys) == batchSize && !send() {
+			return
+		}
+	}
+	if len(keys) > 0 {
+		send()
+	}
+}
+
+func (w *Warmer) warm(b warmBatch) warmResult {
+	r := warmResult{seq: b.seq, keys: b.keys, scanned: len(b.keys)}
+	missing, err := w.Cache.missing(b.keys)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.skipped = len(b.keys) - len(missing)
+	if len(missing) == 0 {
+		return r
+	}
+	objects, err := w.Load(missing)
+	if err != nil {
+		r.err = errors.Wrap(err, "load failed")
+		return r
+	}
+	items := make([]*Item, 0, len(objects))
+	for key, object := range objects {
+		items = append(items, &Item{Key: key, Object: object, Expiration: w.Expiration})
+	}
+	if len(items) == 0 {
+		return r
+	}
+	// Loaded values are only cached, never written back to a DataSource.
+	values, err := w.Cache.marshalMulti(items)
+	if err == nil {
+		err = w.Cache.setMulti(items, values)
+	}
+	if err != nil {
+		r.err = errors.Wrap(err, "SetMulti failed")
+		return r
+	}
+	r.loaded = len(items)
+	return r
+}
+
+func (c *Cache) missing(keys []string) ([]string, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		if err := conn.Send("EXISTS", key); err != nil {
+			return nil, errors.Wrap(err, "Redis EXISTS failed")
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis EXISTS failed")
+	}
+	var missing []string
+	for i, reply := range replies {
+		exists, err := redis.Bool(reply, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Redis EXISTS failed")
+		}
+		if !exists {
+			missing = append(missing, keys[i])
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,452 @@
+package rcache
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrWriteBehindStarted = errors.New("cache: write-behind is already started")
+
+const (
+	opStore  = "store"
+	opDelete = "delete"
+)
+
+type WriteBehindOptions struct {
+	// Stream is the Redis stream queueing the writes, "rcache:write-behind"
+	// by default. The ID of the last write queued for each key is kept in
+	// the hash Stream + ":latest", so that older writes are never applied
+	// after it.
+	Stream string
+	// Group is the consumer group shared by all instances, "rcache" by
+	// default.
+	Group string
+	// Consumer names this instance within Group. It must be stable across
+	// restarts for unacknowledged writes to be retried, the default is the
+	// host name.
+	Consumer string
+	// BatchSize is the maximum number of queued writes applied at once.
+	BatchSize int
+	// PollInterval is how long to wait for new writes before checking for
+	// Close.
+	PollInterval time.Duration
+	// MaxRetryBackoff caps the delay between retries of failed batches.
+	MaxRetryBackoff time.Duration
+	// ClaimIdle is how long writes read by another consumer may stay
+	// unacknowledged before this one claims them, 5 minutes by default. It
+	// recovers the writes of consumers that never come back, such as
+	// instances whose host name changed.
+	ClaimIdle time.Duration
+}
+
+func (o WriteBehindOptions) withDefaults() WriteBehindOptions {
+	if o.Stream == "" {
+		o.Stream = "rcache:write-behind"
+	}
+	if o.Group == "" {
+		o.Group = "rcache"
+	}
+	if o.Consumer == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = fmt.Sprintf("pid-%d", os.Getpid())
+		}
+		o.Consumer = host
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = time.Minute
+	}
+	if o.ClaimIdle <= 0 {
+		o.ClaimIdle = 5 * time.Minute
+	}
+	return o
+}
+
+type writeBehind struct {
+	opts WriteBehindOptions
+	stop chan struct{}
+	done chan struct{}
+}
+
+type writeOp struct {
+	id    string
+	op    string
+	key   string
+	value []byte
+}
+
+func latestKey(opts WriteBehindOptions) string {
+	return opts.Stream + ":latest"
+}
+
+// enqueueScript queues a write and records it as the latest of its key.
+var enqueueScript = redis.NewScript(2, `
+-- rcache:enqueue
+local id = redis.call("XADD", KEYS[1], "*", unpack(ARGV, 2))
+redis.call("HSET", KEYS[2], ARGV[1], id)
+return id
+`)
+
+// clearLatestScript forgets the latest writes of keys, given as key and ID
+// pairs, unless newer writes were queued in the meantime.
+var clearLatestScript = redis.NewScript(1, `
+-- rcache:clear-latest
+for i = 1, #ARGV, 2 do
+	if redis.call("HGET", KEYS[1], ARGV[i]) == ARGV[i + 1] then
+		redis.call("HDEL", KEYS[1], ARGV[i])
+	end
+end
+return 0
+`)
+
+func (c *Cache) enqueue(conn redis.Conn, op, key string, value []byte) error {
+	opts := c.WriteBehind.withDefaults()
+	args := []interface{}{opts.Stream, latestKey(opts), key, "op", op, "key", key}
+	if op == opStore {
+		args = append(args, "value", value)
+	}
+	if err := enqueueScript.Send(conn, args...); err != nil {
+		return errors.Wrap(err, "Redis XADD failed")
+	}
+	return nil
+}
+
+// queuedWrite returns the latest write of key that was not applied yet, or
+// nil if there is none.
+func (c *Cache) queuedWrite(conn redis.Conn, key string) (*writeOp, error) {
+	opts := c.WriteBehind.withDefaults()
+	id, err := redis.String(conn.Do("HGET", latestKey(opts), key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis HGET failed")
+	}
+	entries, err := redis.Values(conn.Do("XRANGE", opts.Stream, id, id))
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis XRANGE failed")
+	}
+	ops, err := parseWrites(entries)
+	if err != nil || len(ops) == 0 {
+		// The write was applied since.
+		return nil, err
+	}
+	return &ops[0], nil
+}
+
+// StartWriteBehind starts applying queued writes to the DataSource until
+// Close is called. Writes queued by any instance are applied, including
+// writes that were left unacknowledged by a previous run of this consumer
+// or, after WriteBehindOptions.ClaimIdle, by any other consumer.
+func (c *Cache) StartWriteBehind() error {
+	opts := c.WriteBehind.withDefaults()
+
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	_, err = conn.Do("XGROUP", "CREATE", opts.Stream, opts.Group, "0", "MKSTREAM")
+	conn.Close()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrap(err, "Redis XGROUP CREATE failed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer != nil {
+		return ErrWriteBehindStarted
+	}
+	c.writer = &writeBehind{
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go c.runWriteBehind(c.writer)
+	return nil
+}
+
+func (c *Cache) runWriteBehind(w *writeBehind) {
+	defer close(w.done)
+	// Start with the writes this consumer read but did not acknowledge.
+	pending := true
+	var backoff time.Duration
+	var claimed time.Time
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		// Writes abandoned by other consumers are claimed every ClaimIdle,
+		// until none is left.
+		claiming := !pending && time.Since(claimed) >= w.opts.ClaimIdle
+		var ops []writeOp
+		var err error
+		if claiming {
+			ops, err = c.claimWrites(w.opts)
+		} else {
+			ops, err = c.readWrites(w.opts, pending)
+		}
+		if err == nil {
+			if claiming && len(ops) == 0 {
+				claimed = time.Now()
+				continue
+			}
+			if pending && len(ops) == 0 {
+				pending = false
+				continue
+			}
+			err = c.applyWrites(w.opts, ops)
+		}
+		if err == nil {
+			backoff = 0
+			continue
+		}
+
+		c.handleError(errors.Wrap(err, "write-behind failed"))
+		pending = true
+		backoff = nextBackoff(backoff, w.opts.MaxRetryBackoff)
+		if !sleep(backoff, w.stop) {
+			return
+		}
+	}
+}
+
+func (c *Cache) readWrites(opts WriteBehindOptions, pending bool) ([]writeOp, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	args := []interface{}{"GROUP", opts.Group, opts.Consumer, "COUNT", opts.BatchSize}
+	if pending {
+		args = append(args, "STREAMS", opts.Stream, "0")
+	} else {
+		args = append(args, "BLOCK", int64(opts.PollInterval/time.Millisecond), "STREAMS", opts.Stream, ">")
+	}
+	reply, err := redis.Values(redis.DoWithTimeout(conn, opts.PollInterval+5*time.Second, "XREADGROUP", args...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis XREADGROUP failed")
+	}
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	stream, err := redis.Values(reply[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, errors.Errorf("unexpected XREADGROUP reply %v", reply[0])
+	}
+	entries, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unexpected XREADGROUP reply")
+	}
+	return parseWrites(entries)
+}
+
+// claimWrites claims up to BatchSize writes that other consumers left
+// unacknowledged for longer than ClaimIdle.
+func (c *Cache) claimWrites(opts WriteBehindOptions) ([]writeOp, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	minIdle := int64(opts.ClaimIdle / time.Millisecond)
+	var ids []interface{}
+	start := "-"
+	for len(ids) < opts.BatchSize {
+		reply, err := redis.Values(conn.Do("XPENDING", opts.Stream, opts.Group, start, "+", opts.BatchSize))
+		if err != nil {
+			return nil, errors.Wrap(err, "Redis XPENDING failed")
+		}
+		var last string
+		for _, entry := range reply {
+			fields, err := redis.Values(entry, nil)
+			if err != nil || len(fields) != 4 {
+				return nil, errors.Errorf("unexpected XPENDING entry %v", entry)
+			}
+			last, _ = redis.String(fields[0], nil)
+			consumer, _ := redis.String(fields[1], nil)
+			idle, _ := redis.Int64(fields[2], nil)
+			if consumer != opts.Consumer && idle >= minIdle && len(ids) < opts.BatchSize {
+				ids = append(ids, last)
+			}
+		}
+		next := nextStreamID(last)
+		if len(reply) < opts.BatchSize || next == "" {
+			break
+		}
+		start = next
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := append([]interface{}{opts.Stream, opts.Group, opts.Consumer, minIdle}, ids...)
+	entries, err := redis.Values(conn.Do("XCLAIM", args...))
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis XCLAIM failed")
+	}
+	return parseWrites(entries)
+}
+
+// nextStreamID returns the smallest stream ID above id, or an empty string
+// if id is invalid.
+func nextStreamID(id string) string {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return ""
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return ""
+	}
+	return id[:i+1] + strconv.FormatUint(seq+1, 10)
+}
+
+func parseWrites(entries []interface{}) ([]writeOp, error) {
+	ops := make([]writeOp, 0, len(entries))
+	for _, entry := range entries {
+		if entry == nil {
+			// XCLAIM returns nil for entries deleted from the stream.
+			continue
+		}
+		fields, err := redis.Values(entry, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errors.Errorf("unexpected stream entry %v", entry)
+		}
+		var op writeOp
+		if op.id, err = redis.String(fields[0], nil); err != nil {
+			return nil, errors.Wrap(err, "unexpected stream entry")
+		}
+		// Entries deleted from the stream are returned without fields.
+		values, _ := redis.Values(fields[1], nil)
+		for i := 0; i+1 < len(values); i += 2 {
+			name, _ := redis.String(values[i], nil)
+			switch name {
+			case "op":
+				op.op, _ = redis.String(values[i+1], nil)
+			case "key":
+				op.key, _ = redis.String(values[i+1], nil)
+			case "value":
+				op.value, _ = redis.Bytes(values[i+1], nil)
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// applyWrites coalesces ops by key, keeping the last write of each key, and
+// acknowledges them once the DataSource accepted all of them. Writes that are
+// not the latest of their key are skipped: they were superseded by a write
+// that is applied by whoever read it, or was applied already. This happens
+// to writes that were retried or claimed from another consumer.
+func (c *Cache) applyWrites(opts WriteBehindOptions, ops []writeOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	conn, err := c.getConn()
+	if err != nil {
+		return errors.Wrap(err, "getConn failed")
+	}
+	defer conn.Close()
+
+	last := make(map[string]writeOp, len(ops))
+	for _, op := range ops {
+		if op.key != "" {
+			last[op.key] = op
+		}
+	}
+	args := []interface{}{latestKey(opts)}
+	for key := range last {
+		args = append(args, key)
+	}
+	var latest []string
+	if len(args) > 1 {
+		if latest, err = redis.Strings(conn.Do("HMGET", args...)); err != nil {
+			return errors.Wrap(err, "Redis HMGET failed")
+		}
+	}
+	applied := []interface{}{latestKey(opts)}
+	for i, key := range args[1:] {
+		op := last[key.(string)]
+		if latest[i] != op.id {
+			delete(last, op.key)
+			continue
+		}
+		applied = append(applied, op.key, op.id)
+	}
+
+	stores := make(map[string][]byte)
+	var deletes []string
+	for key, op := range last {
+		switch op.op {
+		case opStore:
+			stores[key] = op.value
+		case opDelete:
+			deletes = append(deletes, key)
+		}
+	}
+
+	if batch, ok := c.DataSource.(BatchDataSource); ok {
+		if len(stores) > 0 {
+			if err := batch.StoreMulti(stores); err != nil {
+				return errors.Wrap(err, "DataSource.StoreMulti failed")
+			}
+		}
+		if len(deletes) > 0 {
+			if err := batch.DeleteMulti(deletes); err != nil {
+				return errors.Wrap(err, "DataSource.DeleteMulti failed")
+			}
+		}
+	} else {
+		for key, value := range stores {
+			if err := c.DataSource.Store(key, value); err != nil {
+				return errors.Wrapf(err, "DataSource.Store of %q failed", key)
+			}
+		}
+		for _, key := range deletes {
+			if err := c.DataSource.Delete(key); err != nil {
+				return errors.Wrapf(err, "DataSource.Delete of %q failed", key)
+			}
+		}
+	}
+
+	if len(applied) > 1 {
+		if err := clearLatestScript.Send(conn, applied...); err != nil {
+			return errors.Wrap(err, "Redis clear script failed")
+		}
+	}
+	ids := make([]interface{}, 0, len(ops)+2)
+	ids = append(ids, opts.Stream, opts.Group)
+	for _, op := range ops {
+		ids = append(ids, op.id)
+	}
+	if err := conn.Send("XACK", ids...); err != nil {
+		return errors.Wrap(err, "Redis XACK failed")
+	}
+	if err := conn.Send("XDEL", append([]interface{}{opts.Stream}, ids[2:]...)...); err != nil {
+		return errors.Wrap(err, "Redis XDEL failed")
+	}
+	if err := checkReplies(conn.Do("")); err != nil {
+		return errors.Wrap(err, "Redis XACK failed")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package rcache_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	rcache "github.com/lcd1232/redis-cache"
+	"github.com/lcd1232/redis-cache/rcachetest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSource is a DataSource keeping values in memory.
+type memSource struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	err     error
+	stores  int
+	loading func(key string)
+}
+
+func newMemSource() *memSource {
+	return &memSource{values: make(map[string][]byte)}
+}
+
+func (s *memSource) Load(key string) ([]byte, error) {
+	if s.loading != nil {
+		s.loading(key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	v, ok := s.values[key]
+	if !ok {
+		return nil, rcache.ErrCacheMiss
+	}
+	return v, nil
+}
+
+func (s *memSource) Store(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.values[key] = value
+	s.stores++
+	return nil
+}
+
+func (s *memSource) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memSource) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return string(v), ok
+}
+
+func (s *memSource) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func newWriteBehindCache(pool rcache.Pool, source rcache.DataSource, consumer string) *rcache.Cache {
+	c := rcache.NewRedisCache(pool, json.Marshal, json.Unmarshal)
+	c.DataSource = source
+	c.WriteMode = rcache.WriteBehind
+	c.WriteBehind = rcache.WriteBehindOptions{
+		Consumer:     consumer,
+		PollInterval: 10 * time.Millisecond,
+	}
+	return c
+}
+
+// eventually fails the test if cond does not hold within a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func get(t *testing.T, c *rcache.Cache, key string) (string, error) {
+	t.Helper()
+	var s string
+	err := c.Get(key, &s)
+	return s, err
+}
+
+func TestWriteBehind(t *testing.T) {
+	source := newMemSource()
+	source.values["a"] = []byte(`"stored"`)
+	c := newWriteBehindCache(rcachetest.NewFake(), source, "test")
+	defer c.Close()
+
+	if err := c.Set(&rcache.Item{Key: "b", Object: "queued", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := get(t, c, "b"); err != nil || s != "queued" {
+		t.Errorf("Get(b) = %q, %v, want queued", s, err)
+	}
+	if _, ok := source.get("b"); ok {
+		t.Errorf("b was stored before write-behind started")
+	}
+
+	if err := c.StartWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the writes to be applied", func() bool {
+		_, deleted := source.get("a")
+		b, _ := source.get("b")
+		return !deleted && b == `"queued"`
+	})
+}
+
+// Writes still queued must win over the DataSource, which does not reflect
+// them yet.
+func TestWriteBehindQueuedLoad(t *testing.T) {
+	pool := rcachetest.NewFake()
+	source := newMemSource()
+	source.values["k"] = []byte(`"old"`)
+	source.values["deleted"] = []byte(`"old"`)
+	c := newWriteBehindCache(pool, source, "test")
+	defer c.Close()
+
+	if err := c.Set(&rcache.Item{Key: "k", Object: "new", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	// The cached value is evicted before the write is applied.
+	conn := pool.Get()
+	if _, err := conn.Do("DEL", "k"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if s, err := get(t, c, "k"); err != nil || s != "new" {
+		t.Errorf("Get(k) = %q, %v, want new", s, err)
+	}
+	if s, err := get(t, c, "deleted"); err != rcache.ErrCacheMiss {
+		t.Errorf("Get(deleted) = %q, %v, want ErrCacheMiss", s, err)
+	}
+	// The queued delete must not have been cached over.
+	if s, err := get(t, c, "deleted"); err != rcache.ErrCacheMiss {
+		t.Errorf("second Get(deleted) = %q, %v, want ErrCacheMiss", s, err)
+	}
+}
+
+// A write claimed from a dead consumer must not overwrite a newer write that
+// was applied in the meantime.
+func TestWriteBehindClaimOrder(t *testing.T) {
+	pool := rcachetest.NewFake()
+	source := newMemSource()
+	source.setErr(errors.New("unavailable"))
+
+	dead := newWriteBehindCache(pool, source, "dead")
+	if err := dead.StartWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dead.Set(&rcache.Item{Key: "k", Object: "v1", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	pending := func() int {
+		conn := pool.Get()
+		defer conn.Close()
+		reply, err := redis.Values(conn.Do("XPENDING", "rcache:write-behind", "rcache", "-", "+", 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(reply)
+	}
+	eventually(t, "the write to be read", func() bool { return pending() == 1 })
+	dead.Close()
+	source.setErr(nil)
+
+	c := newWriteBehindCache(pool, source, "alive")
+	c.WriteBehind.ClaimIdle = 20 * time.Millisecond
+	defer c.Close()
+	if err := c.Set(&rcache.Item{Key: "k", Object: "v2", Expiration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the writes to be applied", func() bool {
+		v, _ := source.get("k")
+		return v == `"v2"` && pending() == 0
+	})
+	if v, _ := source.get("k"); v != `"v2"` {
+		t.Errorf("DataSource holds %s, want the newer write", v)
+	}
+	if source.stores != 1 {
+		t.Errorf("DataSource received %d stores, want 1", source.stores)
+	}
+}
+
+func TestLoadReleasesLease(t *testing.T) {
+	pool := rcachetest.NewFake()
+	source := newMemSource()
+	c := rcache.NewRedisCache(pool, json.Marshal, json.Unmarshal)
+	c.DataSource = source
+	c.LeaseTimeout = 500 * time.Millisecond
+
+	var leaseTTL int64
+	source.loading = func(key string) {
+		conn := pool.Get()
+		defer conn.Close()
+		leaseTTL, _ = redis.Int64(conn.Do("PTTL", "{"+key+"}:rcache-lease"))
+	}
+	if _, err := get(t, c, "missing"); err != rcache.ErrCacheMiss {
+		t.Fatalf("Get(missing) = %v, want ErrCacheMiss", err)
+	}
+	if leaseTTL <= 0 || leaseTTL > 500 {
+		t.Errorf("lease TTL = %dms, want at most 500ms", leaseTTL)
+	}
+	if lease, _ := c.GetLease("missing", nil); lease == "" {
+		t.Errorf("the lease of a missing key was not released")
+	}
+
+	source.setErr(errors.New("unavailable"))
+	if _, err := get(t, c, "failing"); err == nil {
+		t.Fatalf("Get succeeded with a failing DataSource")
+	}
+	if lease, _ := c.GetLease("failing", nil); lease == "" {
+		t.Errorf("the lease of a failed load was not released")
+	}
+}